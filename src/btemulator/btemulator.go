@@ -0,0 +1,57 @@
+// Package btemulator runs an in-process bigtable emulator for tests.
+package btemulator
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client returns a client of a new in-process bigtable emulator holding tables,
+// each with column family 0 like the tables of createtable. The emulator is
+// stopped when the test ends.
+func Client(t testing.TB, tables ...string) *bigtable.Client {
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("cannot start bigtable emulator, err [%v]", err)
+	}
+	t.Cleanup(srv.Close)
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("cannot connect to bigtable emulator, err [%v]", err)
+	}
+
+	ctx := context.Background()
+	adminClient, err := bigtable.NewAdminClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("cannot create admin client, err [%v]", err)
+	}
+	for _, e := range tables {
+		err = adminClient.CreateTable(ctx, e)
+		if err != nil {
+			t.Fatalf("cannot create table [%v], err [%v]", e, err)
+		}
+		err = adminClient.CreateColumnFamily(ctx, e, "0")
+		if err != nil {
+			t.Fatalf("cannot create column family 0 of table [%v], err [%v]", e, err)
+		}
+	}
+
+	client, err := bigtable.NewClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("cannot create client, err [%v]", err)
+	}
+
+	return client
+}
+
+// Table returns table in a new in-process bigtable emulator, see Client.
+func Table(t testing.TB, table string) *bigtable.Table {
+	return Client(t, table).Open(table)
+}
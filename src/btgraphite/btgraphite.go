@@ -0,0 +1,71 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func main() {
+	var (
+		project      = flag.String("project", "", "The name of the project.")
+		instance     = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile     = flag.String("authjson", "", "Google application credentials json file.")
+		table        = flag.String("table", "sec", "Table to query and write.")
+		indexTable   = flag.String("index_table", "", "Series index table to resolve globs, tags and /metrics/find. Empty allows plain series names only.")
+		listen       = flag.String("listen", ":8080", "Address to serve the graphite http api on.")
+		numReaders   = flag.Int("num_readers", 16, "Number of series of a request to read in parallel.")
+		carbonListen = flag.String("carbon_listen", "", "Address to receive the graphite plaintext protocol on, tcp and udp. Empty disables ingestion.")
+		batcherFlags = btutil.NewBatcherFlags(10, 1000)
+		schemaFlags  = btutil.NewSchemaFlags("sec")
+	)
+
+	//eg: bin/btgraphite -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec -index_table index
+
+	flag.Parse()
+	if *project == "" || *instance == "" || *authfile == "" || *numReaders <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	client, _ := btutil.Clients(*project, *instance, *authfile)
+	tbl := client.Open(*table)
+	schema := schemaFlags.Schema()
+
+	s := &server{
+		reader:     btread.NewReader(tbl, schema),
+		numReaders: *numReaders,
+		now:        time.Now,
+	}
+	if *indexTable != "" {
+		s.index = btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+	}
+
+	if *carbonListen != "" {
+		batcher := btutil.NewBatcher(context.Background(), tbl, schema, s.index, batcherFlags.Config())
+		c := &carbonListener{batcher: batcher, now: time.Now}
+
+		ln, err := net.Listen("tcp", *carbonListen)
+		if err != nil {
+			log.Fatalf("cannot listen on tcp [%v], err [%v]", *carbonListen, err)
+		}
+		conn, err := net.ListenPacket("udp", *carbonListen)
+		if err != nil {
+			log.Fatalf("cannot listen on udp [%v], err [%v]", *carbonListen, err)
+		}
+
+		log.Printf("receiving graphite plaintext protocol on [%v]", *carbonListen)
+		go c.serveTCP(ln)
+		go c.serveUDP(conn)
+	}
+
+	log.Printf("serving graphite api on [%v]", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s.handler()))
+}
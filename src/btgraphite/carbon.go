@@ -0,0 +1,115 @@
+package main
+
+import (
+	"btutil"
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseCarbonLine parses a line of the graphite plaintext protocol,
+// "name value timestamp". Tagged names, name;tag=value;..., become the labels
+// of the series. A timestamp of -1 is now.
+func parseCarbonLine(line string, now time.Time) (btutil.KeyValueEpochsec, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid line [%v]. should be name value timestamp", line))
+	}
+
+	parts := strings.Split(fields[0], ";")
+	labels := make(map[string]string)
+	for _, e := range parts[1:] {
+		i := strings.IndexByte(e, '=')
+		if i <= 0 {
+			return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid tag [%v] in line [%v]", e, line))
+		}
+		labels[e[:i]] = e[i+1:]
+	}
+	if parts[0] == "" {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("empty name in line [%v]", line))
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid value in line [%v]", line))
+	}
+
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid timestamp in line [%v]", line))
+	}
+	if ts == -1 {
+		ts = float64(now.Unix())
+	}
+
+	return btutil.KeyValueEpochsec{
+		Series:   btutil.NewSeries(parts[0], labels),
+		Value:    value,
+		Epochsec: btutil.Epochsec(int64(ts)),
+	}, nil
+}
+
+// carbonListener receives lines of the graphite plaintext protocol and writes
+// their points through a batcher.
+type carbonListener struct {
+	batcher *btutil.Batcher
+	now     func() time.Time
+}
+
+// serveTCP accepts connections of ln, each sending lines, until ln is closed.
+func (c *carbonListener) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("stopped accepting carbon connections, err [%v]", err)
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+func (c *carbonListener) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		c.handleLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("cannot read carbon connection [%v], err [%v]", conn.RemoteAddr(), err)
+	}
+}
+
+// serveUDP reads packets of conn, each holding lines, until conn is closed.
+func (c *carbonListener) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("stopped reading carbon packets, err [%v]", err)
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			c.handleLine(line)
+		}
+	}
+}
+
+func (c *carbonListener) handleLine(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+
+	kves, err := parseCarbonLine(line, c.now())
+	if err != nil {
+		log.Printf("skipping carbon line, err [%v]", err)
+		return
+	}
+
+	c.batcher.Add([]btutil.KeyValueEpochsec{kves}, nil)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"btservertest"
+	"btutil"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseCarbonLine(t *testing.T) {
+	const fn = "TestParseCarbonLine"
+
+	now := time.Unix(5000, 0)
+	tests := []struct {
+		line     string
+		expected btutil.KeyValueEpochsec
+	}{
+		{"servers.a.cpu 1.5 1000", btutil.KeyValueEpochsec{Series: btutil.Series{Name: "servers.a.cpu"}, Value: 1.5, Epochsec: 1000}},
+		{"cpu;host=a;dc=east -2 1000.7\n", btutil.KeyValueEpochsec{
+			Series:   btutil.NewSeries("cpu", map[string]string{"host": "a", "dc": "east"}),
+			Value:    -2,
+			Epochsec: 1000,
+		}},
+		{"cpu  3\t-1", btutil.KeyValueEpochsec{Series: btutil.Series{Name: "cpu"}, Value: 3, Epochsec: 5000}},
+	}
+
+	for _, e := range tests {
+		actual, err := parseCarbonLine(e.line, now)
+		if err != nil || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: %q: expected [%+v], got [%+v], err [%v]", fn, e.line, e.expected, actual, err)
+		}
+	}
+
+	for _, e := range []string{"cpu 1", "cpu x 1000", "cpu 1 x", "cpu;host 1 1000", ";host=a 1 1000", "a b c d"} {
+		if _, err := parseCarbonLine(e, now); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
+
+func TestCarbonListener(t *testing.T) {
+	const fn = "TestCarbonListener"
+
+	ctx := context.Background()
+	f := btservertest.New(t, "sec", nil)
+	c := &carbonListener{batcher: f.Batcher(), now: time.Now}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("%v: cannot listen on tcp, err [%v]", fn, err)
+	}
+	defer ln.Close()
+	go c.serveTCP(ln)
+
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatalf("%v: cannot listen on udp, err [%v]", fn, err)
+	}
+	defer pc.Close()
+	go c.serveUDP(pc)
+
+	send := func(network, addr, lines string) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("%v: cannot dial [%v], err [%v]", fn, network, err)
+		}
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, lines)
+		if err != nil {
+			t.Fatalf("%v: cannot send on [%v], err [%v]", fn, network, err)
+		}
+	}
+	send("tcp", ln.Addr().String(), "tcp.metric 1 1000\ninvalid\ntcp.metric 2 1001\n")
+	send("udp", pc.LocalAddr().String(), "udp.metric 3 1000\nudp.metric 4 1001")
+
+	reader := f.Reader
+	for _, name := range []string{"tcp.metric", "udp.metric"} {
+		var points []btutil.TimeValue
+		for deadline := time.Now().Add(10 * time.Second); len(points) < 2 && time.Now().Before(deadline); {
+			time.Sleep(100 * time.Millisecond)
+			points, err = reader.Read(ctx, btutil.Series{Name: name}, 0, 2000)
+			if err != nil {
+				t.Fatalf("%v: cannot read [%v], err [%v]", fn, name, err)
+			}
+		}
+
+		if len(points) != 2 || points[0].Epochsec != 1000 || points[1].Epochsec != 1001 {
+			t.Errorf("%v: expected 2 points of [%v], got [%v]", fn, name, points)
+		}
+	}
+}
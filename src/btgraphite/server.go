@@ -0,0 +1,315 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// server serves the subset of the graphite http api used by the grafana
+// graphite datasource, /render and /metrics/find.
+type server struct {
+	reader *btread.Reader
+	// index resolves globs and tag queries, nil if only plain names are served
+	index      *btutil.SeriesIndex
+	numReaders int
+	now        func() time.Time
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/render", s.render)
+	mux.HandleFunc("/metrics/find", s.find)
+	return mux
+}
+
+// renderSeries is a series of the json format of /render.
+type renderSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][2]float64      `json:"datapoints"`
+}
+
+// render serves /render?target=...&from=...&until=...&format=json. Every
+// target is a series name, a graphite glob of series names or a
+// seriesByTag('tag=value',...) call. Points are averaged down to at most
+// maxDataPoints if given.
+func (s *server) render(w http.ResponseWriter, r *http.Request) {
+	if format := r.FormValue("format"); format != "json" {
+		http.Error(w, fmt.Sprintf("unsupported format [%v]. only json is supported", format), http.StatusBadRequest)
+		return
+	}
+
+	now := s.now()
+	from, err := parseTime(r.FormValue("from"), now, now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTime(r.FormValue("until"), now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from > until {
+		http.Error(w, fmt.Sprintf("from [%v] is after until [%v]", from, until), http.StatusBadRequest)
+		return
+	}
+
+	var maxDataPoints uint32
+	if str := r.FormValue("maxDataPoints"); str != "" {
+		n, err := strconv.ParseUint(str, 10, 32)
+		if err != nil || n == 0 {
+			http.Error(w, fmt.Sprintf("invalid maxDataPoints [%v]", str), http.StatusBadRequest)
+			return
+		}
+		maxDataPoints = uint32(n)
+	}
+
+	ctx := r.Context()
+	var seriesList []btutil.Series
+	for _, target := range r.Form["target"] {
+		found, err := s.resolve(ctx, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		seriesList = append(seriesList, found...)
+	}
+
+	// until is inclusive in graphite
+	end := until
+	if end < math.MaxUint32 {
+		end++
+	}
+	results, err := s.reader.ReadMany(ctx, seriesList, from, end, s.numReaders)
+	if err != nil {
+		log.Printf("cannot read series of [%v], err [%v]", r.Form["target"], err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]renderSeries, 0, len(seriesList))
+	for i, series := range seriesList {
+		points := results[i]
+		if maxDataPoints != 0 && uint32(len(points)) > maxDataPoints {
+			step := (until - from + maxDataPoints) / maxDataPoints
+			points = btread.Downsample(points, step, avg)
+		}
+
+		rs := renderSeries{
+			Target:     series.String(),
+			Tags:       map[string]string{"name": series.Name},
+			Datapoints: make([][2]float64, 0, len(points)),
+		}
+		for _, e := range series.Labels {
+			rs.Tags[e.Name] = e.Value
+		}
+		for _, e := range points {
+			rs.Datapoints = append(rs.Datapoints, [2]float64{e.Value, float64(e.Epochsec)})
+		}
+		response = append(response, rs)
+	}
+
+	btutil.WriteJSON(w, response)
+}
+
+var avg, _ = btread.NewAggregator("avg")
+
+// splitArgs splits the arguments of a call at the commas between them, leaving
+// the commas in quoted arguments.
+func splitArgs(args string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(args); i++ {
+		switch c := args[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			parts = append(parts, args[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, args[start:])
+}
+
+// resolve returns the series of a render target.
+func (s *server) resolve(ctx context.Context, target string) ([]btutil.Series, error) {
+	var matchers []btutil.Matcher
+	if strings.HasPrefix(target, "seriesByTag(") && strings.HasSuffix(target, ")") {
+		args := target[len("seriesByTag(") : len(target)-1]
+		for _, e := range splitArgs(args) {
+			expr := strings.Trim(strings.TrimSpace(e), `'"`)
+			// the name tag, but not tags starting with name, is the name of the series
+			if op := strings.TrimPrefix(expr, "name"); len(op) < len(expr) &&
+				(strings.HasPrefix(op, "=") || strings.HasPrefix(op, "!=")) {
+				expr = "__name__" + op
+			}
+			m, err := btutil.NewTagMatcher(strings.Replace(expr, "!=~", "!~", 1))
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+		}
+	} else if strings.ContainsAny(target, "*?[{") {
+		m, err := btutil.NewGlobMatcher(target)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	} else {
+		return []btutil.Series{{Name: target}}, nil
+	}
+
+	if s.index == nil {
+		return nil, errors.New(fmt.Sprintf("cannot resolve target [%v] without an index table", target))
+	}
+
+	found, err := btutil.Search(ctx, s.index, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []btutil.Series
+	for _, e := range found {
+		result = append(result, e.Series)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+	return result, nil
+}
+
+// findNode is a node of the treejson format of /metrics/find.
+type findNode struct {
+	Text          string `json:"text"`
+	ID            string `json:"id"`
+	Leaf          int    `json:"leaf"`
+	Expandable    int    `json:"expandable"`
+	AllowChildren int    `json:"allowChildren"`
+}
+
+// find serves /metrics/find?query=..., the nodes of the dot separated series
+// names in the index matching the glob query, in treejson format.
+func (s *server) find(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	if query == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	if s.index == nil {
+		http.Error(w, "cannot find metrics without an index table", http.StatusBadRequest)
+		return
+	}
+
+	m, err := btutil.NewGlobMatcher(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	depth := len(strings.Split(query, "."))
+	nodes := make(map[string]*findNode)
+	err = s.index.List(r.Context(), func(info btutil.SeriesInfo) bool {
+		parts := strings.Split(info.Series.Name, ".")
+		if len(parts) < depth {
+			return true
+		}
+
+		id := strings.Join(parts[:depth], ".")
+		if !m.Matches(btutil.Series{Name: id}) {
+			return true
+		}
+
+		node, ok := nodes[id]
+		if !ok {
+			node = &findNode{Text: parts[depth-1], ID: id}
+			nodes[id] = node
+		}
+		if len(parts) == depth {
+			node.Leaf = 1
+		} else {
+			node.Expandable, node.AllowChildren = 1, 1
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("cannot list index for query [%v], err [%v]", query, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]findNode, 0, len(nodes))
+	for _, e := range nodes {
+		response = append(response, *e)
+	}
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].ID < response[j].ID
+	})
+
+	btutil.WriteJSON(w, response)
+}
+
+// relativeUnits are the units of relative graphite times like -5min, in seconds.
+var relativeUnits = []struct {
+	suffix  string
+	seconds int64
+}{
+	{"seconds", 1}, {"second", 1}, {"sec", 1}, {"s", 1},
+	{"minutes", 60}, {"minute", 60}, {"min", 60},
+	{"hours", 3600}, {"hour", 3600}, {"h", 3600},
+	{"days", 86400}, {"day", 86400}, {"d", 86400},
+	{"weeks", 7 * 86400}, {"week", 7 * 86400}, {"w", 7 * 86400},
+	{"months", 30 * 86400}, {"month", 30 * 86400}, {"mon", 30 * 86400},
+	{"years", 365 * 86400}, {"year", 365 * 86400}, {"y", 365 * 86400},
+}
+
+// parseTime parses a graphite from or until time: epoch seconds, now, a time
+// relative to now like -5min or -1d, HH:MM_YYYYMMDD or YYYYMMDD in UTC. The
+// empty string is def.
+func parseTime(str string, now, def time.Time) (uint32, error) {
+	switch {
+	case str == "":
+		return btutil.Epochsec(def.Unix()), nil
+	case str == "now":
+		return btutil.Epochsec(now.Unix()), nil
+	case strings.HasPrefix(str, "-") || strings.HasPrefix(str, "+"):
+		for _, e := range relativeUnits {
+			if !strings.HasSuffix(str, e.suffix) {
+				continue
+			}
+			n, err := strconv.ParseInt(str[:len(str)-len(e.suffix)], 10, 64)
+			if err != nil {
+				continue
+			}
+			return btutil.Epochsec(now.Unix() + n*e.seconds), nil
+		}
+	default:
+		if epochsec, err := strconv.ParseUint(str, 10, 32); err == nil && len(str) != len("20060102") {
+			return uint32(epochsec), nil
+		}
+		for _, layout := range []string{"15:04_20060102", "20060102"} {
+			if t, err := time.Parse(layout, str); err == nil {
+				return btutil.Epochsec(t.Unix()), nil
+			}
+		}
+	}
+
+	return 0, errors.New(fmt.Sprintf("invalid time [%v]", str))
+}
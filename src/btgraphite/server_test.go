@@ -0,0 +1,176 @@
+package main
+
+import (
+	"btservertest"
+	"btutil"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testServer returns a server over an emulator holding the series of ktvs in
+// the sec layout, indexed.
+func testServer(t *testing.T, ktvs []btutil.KeyTimevalues) *httptest.Server {
+	f := btservertest.New(t, "sec", ktvs)
+	s := &server{
+		reader:     f.Reader,
+		index:      f.Index,
+		numReaders: 4,
+		now:        func() time.Time { return time.Unix(1000, 0) },
+	}
+
+	return btservertest.Serve(t, s.handler())
+}
+
+func get(t *testing.T, srv *httptest.Server, path string, params url.Values, v interface{}) int {
+	resp, err := http.Get(srv.URL + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatalf("cannot get [%v], err [%v]", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("cannot decode response of [%v], err [%v]", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestRender(t *testing.T) {
+	const fn = "TestRender"
+
+	points := []btutil.TimeValue{{Epochsec: 700, Value: 1}, {Epochsec: 800, Value: 2}, {Epochsec: 900, Value: 3}}
+	srv := testServer(t, []btutil.KeyTimevalues{
+		{Series: btutil.Series{Name: "servers.a.cpu.user"}, Timevalues: points},
+		{Series: btutil.Series{Name: "servers.b.cpu.sys"}, Timevalues: points[:1]},
+		{Series: btutil.Series{Name: "servers.b.cpu.idle"}, Timevalues: points[:1]},
+		{Series: btutil.NewSeries("mem", map[string]string{"host": "a"}), Timevalues: points[2:]},
+		{Series: btutil.NewSeries("disk", map[string]string{"host": "aa", "namespace": "prod"}), Timevalues: points[2:]},
+	})
+
+	tests := []struct {
+		params   url.Values
+		expected []renderSeries
+	}{
+		{
+			url.Values{"target": {"servers.*.cpu.{user,sys}"}, "from": {"-250s"}, "until": {"900"}},
+			[]renderSeries{
+				{"servers.a.cpu.user", map[string]string{"name": "servers.a.cpu.user"}, [][2]float64{{2, 800}, {3, 900}}},
+				{"servers.b.cpu.sys", map[string]string{"name": "servers.b.cpu.sys"}, [][2]float64{}},
+			},
+		},
+		{
+			url.Values{"target": {"servers.a.cpu.user"}, "from": {"0"}, "maxDataPoints": {"2"}},
+			[]renderSeries{
+				{"servers.a.cpu.user", map[string]string{"name": "servers.a.cpu.user"}, [][2]float64{{2, 501}}},
+			},
+		},
+		{
+			url.Values{"target": {"seriesByTag('name=mem','host=~a|b')"}, "from": {"-1h"}},
+			[]renderSeries{
+				{`mem{host="a"}`, map[string]string{"name": "mem", "host": "a"}, [][2]float64{{3, 900}}},
+			},
+		},
+		// tags starting with name are not the name, and regexes may hold commas
+		{
+			url.Values{"target": {"seriesByTag('namespace=prod', 'host=~a{1,3}')"}, "from": {"-1h"}},
+			[]renderSeries{
+				{`disk{host="aa",namespace="prod"}`, map[string]string{"name": "disk", "host": "aa", "namespace": "prod"}, [][2]float64{{3, 900}}},
+			},
+		},
+		{
+			url.Values{"target": {"nosuch.*"}},
+			[]renderSeries{},
+		},
+	}
+
+	for _, e := range tests {
+		e.params.Set("format", "json")
+		var actual []renderSeries
+		status := get(t, srv, "/render", e.params, &actual)
+		if status != http.StatusOK || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: %v: expected [%+v], got [%v] [%+v]", fn, e.params, e.expected, status, actual)
+		}
+	}
+
+	for _, e := range []url.Values{
+		{"target": {"servers.a.cpu.user"}, "format": {"raw"}},
+		{"target": {"servers.a.cpu.user"}, "format": {"json"}, "from": {"yesterday"}},
+		{"target": {"servers.a.cpu.user"}, "format": {"json"}, "from": {"900"}, "until": {"800"}},
+		{"target": {"seriesByTag('host')"}, "format": {"json"}},
+	} {
+		if status := get(t, srv, "/render", e, nil); status != http.StatusBadRequest {
+			t.Errorf("%v: %v: expected bad request, got [%v]", fn, e, status)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	const fn = "TestFind"
+
+	points := []btutil.TimeValue{{Epochsec: 700, Value: 1}}
+	srv := testServer(t, []btutil.KeyTimevalues{
+		{Series: btutil.Series{Name: "servers.a.cpu"}, Timevalues: points},
+		{Series: btutil.Series{Name: "servers.a.cpu.user"}, Timevalues: points},
+		{Series: btutil.Series{Name: "servers.b.mem"}, Timevalues: points},
+		{Series: btutil.Series{Name: "load"}, Timevalues: points},
+	})
+
+	tests := []struct {
+		query    string
+		expected []findNode
+	}{
+		{"*", []findNode{{"load", "load", 1, 0, 0}, {"servers", "servers", 0, 1, 1}}},
+		{"servers.*", []findNode{{"a", "servers.a", 0, 1, 1}, {"b", "servers.b", 0, 1, 1}}},
+		{"servers.a.*", []findNode{{"cpu", "servers.a.cpu", 1, 1, 1}}},
+		{"servers.{a,b}.mem", []findNode{{"mem", "servers.b.mem", 1, 0, 0}}},
+		{"nosuch", []findNode{}},
+	}
+
+	for _, e := range tests {
+		var actual []findNode
+		status := get(t, srv, "/metrics/find", url.Values{"query": {e.query}}, &actual)
+		if status != http.StatusOK || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: %v: expected [%+v], got [%v] [%+v]", fn, e.query, e.expected, status, actual)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	const fn = "TestParseTime"
+
+	now := time.Unix(1000000, 0)
+	tests := []struct {
+		str      string
+		expected uint32
+	}{
+		{"", 1},
+		{"now", 1000000},
+		{"12345", 12345},
+		{"-5min", 1000000 - 300},
+		{"-2days", 1000000 - 2*86400},
+		{"-1h", 1000000 - 3600},
+		{"+30s", 1000030},
+		{"01:30_19700102", 86400 + 5400},
+		{"19700102", 86400},
+	}
+
+	for _, e := range tests {
+		actual, err := parseTime(e.str, now, time.Unix(1, 0))
+		if err != nil || actual != e.expected {
+			t.Errorf("%v: %v: expected [%v], got [%v], err [%v]", fn, e.str, e.expected, actual, err)
+		}
+	}
+
+	for _, e := range []string{"-5", "-5parsecs", "tomorrow"} {
+		if _, err := parseTime(e, now, now); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
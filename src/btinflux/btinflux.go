@@ -0,0 +1,49 @@
+package main
+
+import (
+	"btutil"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func main() {
+	var (
+		project      = flag.String("project", "", "The name of the project.")
+		instance     = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile     = flag.String("authjson", "", "Google application credentials json file.")
+		table        = flag.String("table", "", "Table to write metrics.")
+		indexTable   = flag.String("index_table", "", "Table to index the written series in. Empty disables the index.")
+		listen       = flag.String("listen", ":8086", "Address to serve the influxdb write api on.")
+		batcherFlags = btutil.NewBatcherFlags(10, 1000)
+		schemaFlags  = btutil.NewSchemaFlags("sec")
+	)
+
+	//eg: bin/btinflux -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec
+
+	flag.Parse()
+	if *project == "" || *instance == "" || *authfile == "" || *table == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	client, _ := btutil.Clients(*project, *instance, *authfile)
+	schema := schemaFlags.Schema()
+
+	var index *btutil.SeriesIndex
+	if *indexTable != "" {
+		index = btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+	}
+
+	s := &server{
+		batcher: btutil.NewBatcher(context.Background(), client.Open(*table), schema, index, batcherFlags.Config()),
+		now:     time.Now,
+	}
+
+	log.Printf("serving influxdb write api on [%v]", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s.handler()))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"btutil"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precisions are the units of timestamps by the precision parameter of /write.
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// parseLine parses a line of the influx line protocol,
+// measurement[,tag=value...] field=value[,field=value...] [timestamp], into a
+// point per field. The series of a field is measurement_field with the tags as
+// labels. Timestamps are in units of precision, now if missing. Boolean fields
+// are 1 or 0 and string fields, which cannot be stored, are left out.
+func parseLine(line string, precision time.Duration, now time.Time) ([]btutil.KeyValueEpochsec, error) {
+	// quotes are only honoured in field values, so that the measurement and
+	// tags end at the first space not escaped
+	keySection := split(line, ' ', false)[0]
+	var sections []string
+	if len(keySection) < len(line) {
+		sections = split(line[len(keySection)+1:], ' ', true)
+	}
+	if len(sections) != 1 && len(sections) != 2 {
+		return nil, errors.New(fmt.Sprintf("invalid line [%v]. should be measurement,tags fields timestamp", line))
+	}
+
+	keys := split(keySection, ',', false)
+	measurement := unescape(keys[0])
+	if measurement == "" {
+		return nil, errors.New(fmt.Sprintf("missing measurement in line [%v]", line))
+	}
+
+	labels := make(map[string]string)
+	for _, e := range keys[1:] {
+		kv := split(e, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New(fmt.Sprintf("invalid tag [%v] in line [%v]", e, line))
+		}
+		labels[unescape(kv[0])] = unescape(kv[1])
+	}
+
+	epochsec := uint32(now.Unix())
+	if len(sections) == 2 {
+		ts, err := strconv.ParseInt(sections[1], 10, 64)
+		var ok bool
+		if err == nil {
+			epochsec, ok = toEpochsec(ts, precision)
+		}
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid timestamp in line [%v]", line))
+		}
+	}
+
+	var points []btutil.KeyValueEpochsec
+	for _, e := range split(sections[0], ',', true) {
+		kv := split(e, '=', true)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New(fmt.Sprintf("invalid field [%v] in line [%v]", e, line))
+		}
+
+		value, ok, err := parseFieldValue(kv[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid value of field [%v] in line [%v], err [%v]", kv[0], line, err))
+		}
+		if !ok {
+			continue
+		}
+
+		points = append(points, btutil.KeyValueEpochsec{
+			Series:   btutil.NewSeries(measurement+"_"+unescape(kv[0]), labels),
+			Value:    value,
+			Epochsec: epochsec,
+		})
+	}
+
+	return points, nil
+}
+
+// toEpochsec converts a timestamp in units of precision to seconds, returning
+// false if they are out of the range of uint32.
+func toEpochsec(ts int64, precision time.Duration) (uint32, bool) {
+	if precision >= time.Second {
+		// check the range before multiplying, which could overflow
+		unit := int64(precision / time.Second)
+		if ts < 0 || ts > math.MaxUint32/unit {
+			return 0, false
+		}
+		return uint32(ts * unit), true
+	}
+
+	ts /= int64(time.Second / precision)
+	if ts < 0 || ts > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(ts), true
+}
+
+// parseFieldValue parses a field value, returning false for string values.
+func parseFieldValue(str string) (float64, bool, error) {
+	switch str {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	if strings.HasPrefix(str, `"`) {
+		if len(str) < 2 || !strings.HasSuffix(str, `"`) {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	}
+
+	if strings.HasSuffix(str, "i") {
+		n, err := strconv.ParseInt(str[:len(str)-1], 10, 64)
+		return float64(n), true, err
+	}
+	if strings.HasSuffix(str, "u") {
+		n, err := strconv.ParseUint(str[:len(str)-1], 10, 64)
+		return float64(n), true, err
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		err = errors.New("not a finite number")
+	}
+	return value, true, err
+}
+
+// split splits str at the occurrences of sep that are not escaped with a
+// backslash. If fieldValues, neither are those in a string field value, which
+// is a double quoted string following an equal sign.
+func split(str string, sep byte, fieldValues bool) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && fieldValues && (quoted || (i > 0 && str[i-1] == '=')):
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, str[start:])
+}
+
+// unescape removes the backslashes escaping commas, spaces and equal signs.
+func unescape(str string) string {
+	if strings.IndexByte(str, '\\') == -1 {
+		return str
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`).Replace(str)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"btutil"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	const fn = "TestParseLine"
+
+	now := time.Unix(5000, 0)
+	host := map[string]string{"host": "a", "dc": "us east"}
+	tests := []struct {
+		line      string
+		precision time.Duration
+		expected  []btutil.KeyValueEpochsec
+	}{
+		{"cpu,host=a,dc=us\\ east usage_user=1.5,usage_idle=90i 1000000000000", time.Nanosecond, []btutil.KeyValueEpochsec{
+			{Series: btutil.NewSeries("cpu_usage_user", host), Value: 1.5, Epochsec: 1000},
+			{Series: btutil.NewSeries("cpu_usage_idle", host), Value: 90, Epochsec: 1000},
+		}},
+		{"mem free=7u,up=t,label=\"a b,c\" 1000", time.Second, []btutil.KeyValueEpochsec{
+			{Series: btutil.Series{Name: "mem_free"}, Value: 7, Epochsec: 1000},
+			{Series: btutil.Series{Name: "mem_up"}, Value: 1, Epochsec: 1000},
+		}},
+		{"disk used=2e3 1000500", time.Millisecond, []btutil.KeyValueEpochsec{
+			{Series: btutil.Series{Name: "disk_used"}, Value: 2000, Epochsec: 1000},
+		}},
+		{"net\\,x in\\=b=F", time.Nanosecond, []btutil.KeyValueEpochsec{
+			{Series: btutil.Series{Name: "net,x_in=b"}, Value: 0, Epochsec: 5000},
+		}},
+		// quotes are only honoured in field values
+		{"\"load,host=\"a v\"=1 2", time.Hour, []btutil.KeyValueEpochsec{
+			{Series: btutil.NewSeries("\"load_v\"", map[string]string{"host": "\"a"}), Value: 1, Epochsec: 7200},
+		}},
+	}
+
+	for _, e := range tests {
+		actual, err := parseLine(e.line, e.precision, now)
+		if err != nil || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: [%v]: expected [%+v], got [%+v], err [%v]", fn, e.line, e.expected, actual, err)
+		}
+	}
+
+	for _, e := range []string{
+		"cpu", ",host=a v=1", "cpu,host v=1", "cpu v", "cpu v=x", "cpu v=1 x", "cpu v=1 1 1",
+		"cpu v=\"open", "cpu v=1i2", "cpu v=1 -5000000000",
+	} {
+		if _, err := parseLine(e, time.Nanosecond, now); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+
+	// timestamps that would wrap around to 0 once converted to seconds
+	for _, e := range []time.Duration{time.Minute, time.Hour} {
+		line := "cpu v=1 " + strconv.FormatInt(1<<62, 10)
+		if _, err := parseLine(line, e, now); err == nil {
+			t.Errorf("%v: expected error for [%v] in [%v]", fn, line, e)
+		}
+	}
+	if _, err := parseLine("cpu,host=\"a b\" v=1", time.Nanosecond, now); err == nil {
+		t.Errorf("%v: expected error for a quoted tag value with a space", fn)
+	}
+}
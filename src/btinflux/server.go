@@ -0,0 +1,99 @@
+package main
+
+import (
+	"btutil"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// server serves the write api of influxdb 1.x. Telegraf needs
+// skip_database_creation, as databases are not supported.
+type server struct {
+	batcher *btutil.Batcher
+	now     func() time.Time
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", s.write)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// write serves /write?precision=..., a body of lines of the influx line
+// protocol, optionally gzipped. The points are all written or, if any line is
+// invalid, none. It answers once the points are written.
+func (s *server) write(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("write needs a POST"))
+		return
+	}
+
+	// not FormValue, which would read a form encoded body as the form
+	precision, ok := precisions[r.URL.Query().Get("precision")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("invalid precision [%v]", r.URL.Query().Get("precision"))))
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	now := s.now()
+	var points []btutil.KeyValueEpochsec
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		linePoints, err := parseLine(line, precision, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		points = append(points, linePoints...)
+	}
+	if err := scanner.Err(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(points) != 0 {
+		err := s.batcher.Write(r.Context(), points)
+		if err != nil {
+			log.Printf("cannot write [%v] points, err [%v]", len(points), err)
+			writeError(w, btutil.WriteErrorStatus(err), err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError writes err in the json error format of influxdb.
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"btservertest"
+	"btutil"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWrite(t *testing.T) {
+	const fn = "TestWrite"
+
+	ctx := context.Background()
+	f := btservertest.New(t, "sec", nil)
+	s := &server{
+		batcher: f.Batcher(),
+		now:     func() time.Time { return time.Unix(5000, 0) },
+	}
+	srv := btservertest.Serve(t, s.handler())
+
+	post := func(query, contentType string, body []byte, gzipped bool) int {
+		req, err := http.NewRequest("POST", srv.URL+"/write"+query, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%v: cannot create request, err [%v]", fn, err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: cannot post, err [%v]", fn, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("?db=telegraf&precision=s", "", []byte("cpu,host=a usage=1 1000\n\ncpu,host=a usage=2 1001\n"), false); status != http.StatusNoContent {
+		t.Errorf("%v: expected no content, got [%v]", fn, status)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("cpu,host=a usage=3\n"))
+	gz.Close()
+	if status := post("", "", buf.Bytes(), true); status != http.StatusNoContent {
+		t.Errorf("%v: expected no content for gzipped body, got [%v]", fn, status)
+	}
+
+	// the default content type of curl --data-binary
+	if status := post("?precision=s", "application/x-www-form-urlencoded", []byte("cpu,host=a usage=4 1002\n"), false); status != http.StatusNoContent {
+		t.Errorf("%v: expected no content for form encoded body, got [%v]", fn, status)
+	}
+
+	series := btutil.NewSeries("cpu_usage", map[string]string{"host": "a"})
+	actual, err := f.Reader.Read(ctx, series, 0, 10000)
+	expected := []btutil.TimeValue{{Epochsec: 1000, Value: 1}, {Epochsec: 1001, Value: 2}, {Epochsec: 1002, Value: 4}, {Epochsec: 5000, Value: 3}}
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%v: expected [%v], got [%v], err [%v]", fn, expected, actual, err)
+	}
+
+	for _, e := range []struct {
+		query, body string
+	}{
+		{"?precision=x", "cpu usage=1"},
+		{"", "cpu usage=1\ncpu usage"},
+	} {
+		if status := post(e.query, "", []byte(e.body), false); status != http.StatusBadRequest {
+			t.Errorf("%v: [%v] [%v]: expected bad request, got [%v]", fn, e.query, e.body, status)
+		}
+	}
+}
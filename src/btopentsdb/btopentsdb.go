@@ -0,0 +1,51 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func main() {
+	var (
+		project      = flag.String("project", "", "The name of the project.")
+		instance     = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile     = flag.String("authjson", "", "Google application credentials json file.")
+		table        = flag.String("table", "", "Table to write and query metrics.")
+		indexTable   = flag.String("index_table", "", "Series index table to index written series in and resolve queries with.")
+		listen       = flag.String("listen", ":4242", "Address to serve the opentsdb http api on.")
+		numReaders   = flag.Int("num_readers", 16, "Number of series of a query to read in parallel.")
+		batcherFlags = btutil.NewBatcherFlags(10, 1000)
+		schemaFlags  = btutil.NewSchemaFlags("sec")
+	)
+
+	//eg: bin/btopentsdb -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec -index_table index
+
+	flag.Parse()
+	if *project == "" || *instance == "" || *authfile == "" || *table == "" || *indexTable == "" || *numReaders <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	client, _ := btutil.Clients(*project, *instance, *authfile)
+	tbl := client.Open(*table)
+	schema := schemaFlags.Schema()
+	index := btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+
+	s := &server{
+		reader:     btread.NewReader(tbl, schema),
+		index:      index,
+		numReaders: *numReaders,
+		batcher:    btutil.NewBatcher(context.Background(), tbl, schema, index, batcherFlags.Config()),
+		now:        time.Now,
+	}
+
+	log.Printf("serving opentsdb api on [%v]", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s.handler()))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"btutil"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// datapoint is a datapoint of /api/put.
+type datapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// point returns the point of the datapoint. Timestamps of more than 10 digits
+// are in millis, else in seconds.
+func (d datapoint) point() (btutil.KeyValueEpochsec, error) {
+	if d.Metric == "" {
+		return btutil.KeyValueEpochsec{}, errors.New("missing metric")
+	}
+
+	ts, err := strconv.ParseInt(d.Timestamp.String(), 10, 64)
+	if err != nil || ts < 0 {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid timestamp [%v]", d.Timestamp))
+	}
+	if len(d.Timestamp.String()) > 10 {
+		ts /= 1000
+	}
+	if ts > math.MaxUint32 {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid timestamp [%v]", d.Timestamp))
+	}
+
+	value, err := strconv.ParseFloat(d.Value.String(), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return btutil.KeyValueEpochsec{}, errors.New(fmt.Sprintf("invalid value [%v]", d.Value))
+	}
+
+	return btutil.KeyValueEpochsec{
+		Series:   btutil.NewSeries(d.Metric, d.Tags),
+		Value:    value,
+		Epochsec: uint32(ts),
+	}, nil
+}
+
+// put serves /api/put, a datapoint or an array of datapoints in json. The
+// datapoints are all written or, if any is invalid, none. It answers once
+// they are written, with the counts of datapoints if summary or details is
+// asked for.
+func (s *server) put(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("put needs a POST"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var datapoints []datapoint
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		err = json.Unmarshal(body, &datapoints)
+	} else {
+		var d datapoint
+		err = json.Unmarshal(body, &d)
+		datapoints = append(datapoints, d)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("cannot parse datapoints, err [%v]", err)))
+		return
+	}
+
+	var points []btutil.KeyValueEpochsec
+	for _, d := range datapoints {
+		kves, err := d.point()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("invalid datapoint [%+v], err [%v]", d, err)))
+			return
+		}
+		points = append(points, kves)
+	}
+
+	if len(points) != 0 {
+		err = s.batcher.Write(r.Context(), points)
+		if err != nil {
+			log.Printf("cannot write [%v] datapoints, err [%v]", len(points), err)
+			writeError(w, btutil.WriteErrorStatus(err), err)
+			return
+		}
+	}
+
+	if _, ok := r.URL.Query()["summary"]; ok {
+		btutil.WriteJSON(w, map[string]int{"success": len(points), "failed": 0})
+		return
+	}
+	if _, ok := r.URL.Query()["details"]; ok {
+		btutil.WriteJSON(w, map[string]interface{}{"success": len(points), "failed": 0, "errors": []string{}})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError writes err in the json error format of opentsdb.
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": err.Error()},
+	})
+}
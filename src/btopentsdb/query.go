@@ -0,0 +1,433 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// queryRequest is the json body of a /api/query.
+type queryRequest struct {
+	Start   json.RawMessage `json:"start"`
+	End     json.RawMessage `json:"end"`
+	Queries []subQuery      `json:"queries"`
+}
+
+// subQuery is a query of a metric, supporting the aggregator, downsample and
+// tags of opentsdb.
+type subQuery struct {
+	Aggregator string            `json:"aggregator"`
+	Metric     string            `json:"metric"`
+	Downsample string            `json:"downsample"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// queryResult is a result of /api/query, the aggregate of a group of series.
+type queryResult struct {
+	Metric        string             `json:"metric"`
+	Tags          map[string]string  `json:"tags"`
+	AggregateTags []string           `json:"aggregateTags"`
+	Dps           map[string]float64 `json:"dps"`
+}
+
+// query serves /api/query, as a json body or as the start, end and m
+// parameters, m being aggregator:[downsample:]metric[{tag=value,...}].
+// Series are grouped by the tags of the query, a value of * matching any value
+// and a|b either value, and their points aggregated by time. Like opentsdb,
+// series without a point at a time of another are interpolated linearly
+// between their points around it, except by zimsum, mimmin and mimmax.
+func (s *server) query(w http.ResponseWriter, r *http.Request) {
+	var req queryRequest
+	var startStr, endStr string
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("cannot parse query, err [%v]", err)))
+			return
+		}
+		startStr, endStr = jsonTime(req.Start), jsonTime(req.End)
+	} else {
+		startStr, endStr = r.FormValue("start"), r.FormValue("end")
+		for _, m := range r.Form["m"] {
+			q, err := parseM(m)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			req.Queries = append(req.Queries, q)
+		}
+	}
+
+	now := s.now()
+	if startStr == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing start"))
+		return
+	}
+	start, err := parseTime(startStr, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	end := btutil.Epochsec(now.Unix())
+	if endStr != "" {
+		end, err = parseTime(endStr, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if len(req.Queries) == 0 || start > end {
+		writeError(w, http.StatusBadRequest, errors.New("missing queries or start after end"))
+		return
+	}
+
+	var plans []plan
+	for _, q := range req.Queries {
+		p, err := newPlan(q)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		plans = append(plans, p)
+	}
+
+	response := []queryResult{}
+	for _, p := range plans {
+		results, err := s.execute(r.Context(), p, start, end)
+		if err != nil {
+			log.Printf("cannot query metric [%v], err [%v]", p.metric, err)
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		response = append(response, results...)
+	}
+
+	btutil.WriteJSON(w, response)
+}
+
+// jsonTime returns a start or end of a json query, a string or a number.
+func jsonTime(raw json.RawMessage) string {
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return str
+	}
+	return string(raw)
+}
+
+// parseM parses the m parameter of a query, aggregator:[downsample:]metric[{tag=value,...}].
+func parseM(m string) (subQuery, error) {
+	var q subQuery
+	metric := m
+	if i := strings.IndexByte(m, '{'); i != -1 {
+		if !strings.HasSuffix(m, "}") {
+			return q, errors.New(fmt.Sprintf("invalid tags in m [%v]", m))
+		}
+		q.Tags = make(map[string]string)
+		for _, e := range strings.Split(m[i+1:len(m)-1], ",") {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return q, errors.New(fmt.Sprintf("invalid tag [%v] in m [%v]", e, m))
+			}
+			q.Tags[kv[0]] = kv[1]
+		}
+		metric = m[:i]
+	}
+
+	parts := strings.Split(metric, ":")
+	switch len(parts) {
+	case 2:
+		q.Aggregator, q.Metric = parts[0], parts[1]
+	case 3:
+		q.Aggregator, q.Downsample, q.Metric = parts[0], parts[1], parts[2]
+	default:
+		return q, errors.New(fmt.Sprintf("invalid m [%v]. should be aggregator:[downsample:]metric[{tags}]", m))
+	}
+
+	return q, nil
+}
+
+// plan is a parsed subQuery.
+type plan struct {
+	metric        string
+	agg           btread.Aggregator
+	step          uint32
+	downsampleAgg btread.Aggregator
+	// interpolate is whether series are interpolated at the times of the others
+	interpolate bool
+	matchers    []btutil.Matcher
+	groupBy     []string
+}
+
+// noInterpolation are the aggregators of opentsdb aggregating only the points
+// at a time, by the aggregator they are equivalent to then.
+var noInterpolation = map[string]string{
+	"zimsum": "sum",
+	"mimmin": "min",
+	"mimmax": "max",
+}
+
+func newPlan(q subQuery) (plan, error) {
+	p := plan{metric: q.Metric}
+	if q.Metric == "" {
+		return p, errors.New("missing metric")
+	}
+
+	aggregator := q.Aggregator
+	p.interpolate = true
+	if e, ok := noInterpolation[aggregator]; ok {
+		aggregator = e
+		p.interpolate = false
+	}
+
+	var err error
+	p.agg, err = btread.NewAggregator(aggregator)
+	if err != nil {
+		return p, err
+	}
+
+	if q.Downsample != "" {
+		p.step, p.downsampleAgg, err = parseDownsample(q.Downsample)
+		if err != nil {
+			return p, err
+		}
+	}
+
+	m, err := btutil.NewLabelMatcher("__name__", "=", q.Metric)
+	if err != nil {
+		return p, err
+	}
+	p.matchers = append(p.matchers, m)
+	for k, v := range q.Tags {
+		op, value := "=", v
+		switch {
+		case v == "*":
+			op, value = "=~", ".+"
+		case strings.Contains(v, "|"):
+			var alternatives []string
+			for _, e := range strings.Split(v, "|") {
+				alternatives = append(alternatives, regexp.QuoteMeta(e))
+			}
+			op, value = "=~", strings.Join(alternatives, "|")
+		}
+
+		m, err := btutil.NewLabelMatcher(k, op, value)
+		if err != nil {
+			return p, err
+		}
+		p.matchers = append(p.matchers, m)
+		p.groupBy = append(p.groupBy, k)
+	}
+	sort.Strings(p.groupBy)
+
+	return p, nil
+}
+
+// execute returns the results of p in [start, end].
+func (s *server) execute(ctx context.Context, p plan, start, end uint32) ([]queryResult, error) {
+	found, err := btutil.Search(ctx, s.index, p.matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	var seriesList []btutil.Series
+	for _, e := range found {
+		seriesList = append(seriesList, e.Series)
+	}
+
+	// end is inclusive in opentsdb
+	until := end
+	if until < math.MaxUint32 {
+		until++
+	}
+	points, err := s.reader.ReadMany(ctx, seriesList, start, until, s.numReaders)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]int)
+	var keys []string
+	for i, series := range seriesList {
+		var key []string
+		for _, e := range p.groupBy {
+			v, _ := series.Label(e)
+			key = append(key, e+"="+v)
+		}
+		k := strings.Join(key, ",")
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], i)
+	}
+	sort.Strings(keys)
+
+	var results []queryResult
+	for _, k := range keys {
+		var members []btutil.Series
+		var memberPoints [][]btutil.TimeValue
+		times := make(map[uint32]bool)
+		for _, i := range groups[k] {
+			members = append(members, seriesList[i])
+
+			seriesPoints := points[i]
+			if p.step != 0 {
+				seriesPoints = btread.Downsample(seriesPoints, p.step, p.downsampleAgg)
+			}
+			memberPoints = append(memberPoints, seriesPoints)
+			for _, e := range seriesPoints {
+				times[e.Epochsec] = true
+			}
+		}
+
+		result := queryResult{Metric: p.metric, Dps: make(map[string]float64)}
+		result.Tags, result.AggregateTags = commonTags(members)
+		for ts := range times {
+			var values []float64
+			for _, e := range memberPoints {
+				if v, ok := valueAt(e, ts, p.interpolate); ok {
+					values = append(values, v)
+				}
+			}
+			result.Dps[strconv.FormatUint(uint64(ts), 10)] = p.agg(values)
+		}
+		if len(result.Dps) != 0 {
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// valueAt returns the value of points, sorted by time, at ts. Without a point
+// at ts, the value is interpolated linearly between the points around ts if
+// interpolate, and there is no value before the first and after the last point.
+func valueAt(points []btutil.TimeValue, ts uint32, interpolate bool) (float64, bool) {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Epochsec >= ts })
+	if i < len(points) && points[i].Epochsec == ts {
+		return points[i].Value, true
+	}
+	if !interpolate || i == 0 || i == len(points) {
+		return 0, false
+	}
+
+	prev, next := points[i-1], points[i]
+	fraction := float64(ts-prev.Epochsec) / float64(next.Epochsec-prev.Epochsec)
+	return prev.Value + (next.Value-prev.Value)*fraction, true
+}
+
+// commonTags returns the labels of all of members with the same value and the
+// names of the other labels, sorted.
+func commonTags(members []btutil.Series) (map[string]string, []string) {
+	tags := make(map[string]string)
+	aggregate := make(map[string]bool)
+	for i, series := range members {
+		for _, e := range series.Labels {
+			if i == 0 {
+				tags[e.Name] = e.Value
+			} else if v, ok := tags[e.Name]; !ok || v != e.Value {
+				aggregate[e.Name] = true
+			}
+		}
+		for k := range tags {
+			if _, ok := series.Label(k); !ok {
+				aggregate[k] = true
+			}
+		}
+	}
+
+	aggregateTags := []string{}
+	for k := range aggregate {
+		delete(tags, k)
+		aggregateTags = append(aggregateTags, k)
+	}
+	sort.Strings(aggregateTags)
+
+	return tags, aggregateTags
+}
+
+// parseDownsample parses a downsample, interval-aggregator[-none], e.g. 1m-avg.
+func parseDownsample(str string) (uint32, btread.Aggregator, error) {
+	parts := strings.Split(str, "-")
+	if len(parts) == 3 && parts[2] == "none" {
+		parts = parts[:2]
+	}
+	if len(parts) != 2 {
+		return 0, nil, errors.New(fmt.Sprintf("invalid downsample [%v]. should be interval-aggregator", str))
+	}
+
+	interval, err := parseDuration(parts[0])
+	if err != nil || interval < 1 || interval > math.MaxUint32 {
+		return 0, nil, errors.New(fmt.Sprintf("invalid interval of downsample [%v]", str))
+	}
+
+	agg, err := btread.NewAggregator(parts[1])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return uint32(interval), agg, nil
+}
+
+// durationUnits are the units of opentsdb durations, in seconds.
+var durationUnits = map[string]int64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+	"d": 86400,
+	"w": 7 * 86400,
+	"n": 30 * 86400,
+	"y": 365 * 86400,
+}
+
+// parseDuration parses an opentsdb duration like 5m into seconds.
+func parseDuration(str string) (int64, error) {
+	if len(str) < 2 {
+		return 0, errors.New(fmt.Sprintf("invalid duration [%v]", str))
+	}
+
+	seconds, ok := durationUnits[str[len(str)-1:]]
+	n, err := strconv.ParseInt(str[:len(str)-1], 10, 64)
+	if !ok || err != nil || n < 0 || n > math.MaxInt64/seconds {
+		return 0, errors.New(fmt.Sprintf("invalid duration [%v]", str))
+	}
+
+	return n * seconds, nil
+}
+
+// parseTime parses an opentsdb time: epoch seconds, or millis if of more than
+// 10 digits, a relative time like 1h-ago or 2006/01/02[-15:04[:05]] in UTC.
+func parseTime(str string, now time.Time) (uint32, error) {
+	if strings.HasSuffix(str, "-ago") {
+		seconds, err := parseDuration(strings.TrimSuffix(str, "-ago"))
+		if err != nil {
+			return 0, err
+		}
+		return btutil.Epochsec(now.Unix() - seconds), nil
+	}
+
+	if ts, err := strconv.ParseInt(str, 10, 64); err == nil && ts >= 0 {
+		if len(str) > 10 {
+			ts /= 1000
+		}
+		return btutil.Epochsec(ts), nil
+	}
+
+	for _, layout := range []string{"2006/01/02-15:04:05", "2006/01/02-15:04", "2006/01/02"} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return btutil.Epochsec(t.Unix()), nil
+		}
+	}
+
+	return 0, errors.New(fmt.Sprintf("invalid time [%v]", str))
+}
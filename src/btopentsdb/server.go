@@ -0,0 +1,24 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"net/http"
+	"time"
+)
+
+// server serves the subset of the opentsdb http api of /api/put and /api/query.
+type server struct {
+	reader     *btread.Reader
+	index      *btutil.SeriesIndex
+	numReaders int
+	batcher    *btutil.Batcher
+	now        func() time.Time
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/put", s.put)
+	mux.HandleFunc("/api/query", s.query)
+	return mux
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"btservertest"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) *httptest.Server {
+	f := btservertest.New(t, "sec", nil)
+	s := &server{
+		reader:     f.Reader,
+		index:      f.Index,
+		numReaders: 4,
+		batcher:    f.Batcher(),
+		now:        func() time.Time { return time.Unix(10000, 0) },
+	}
+
+	return btservertest.Serve(t, s.handler())
+}
+
+func post(t *testing.T, srv *httptest.Server, path, body string, v interface{}) int {
+	resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("cannot post [%v], err [%v]", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("cannot decode response of [%v], err [%v]", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestPutAndQuery(t *testing.T) {
+	const fn = "TestPutAndQuery"
+
+	srv := testServer(t)
+
+	puts := []string{
+		`{"metric": "sys.cpu", "timestamp": 1000, "value": 1, "tags": {"host": "a", "dc": "east"}}`,
+		`[{"metric": "sys.cpu", "timestamp": 1030, "value": "3", "tags": {"host": "a", "dc": "east"}},
+		  {"metric": "sys.cpu", "timestamp": 1000, "value": 10, "tags": {"host": "b", "dc": "east"}},
+		  {"metric": "sys.cpu", "timestamp": 1000, "value": 100, "tags": {"host": "c", "dc": "west"}}]`,
+	}
+	// series not aligned in time: d at 1000, 1020 and 1040, e at 1010 and 1030
+	puts = append(puts, `[{"metric": "sys.disk", "timestamp": 1000, "value": 0, "tags": {"host": "d"}},
+		  {"metric": "sys.disk", "timestamp": 1020, "value": 20, "tags": {"host": "d"}},
+		  {"metric": "sys.disk", "timestamp": 1040, "value": 40, "tags": {"host": "d"}},
+		  {"metric": "sys.disk", "timestamp": 1010, "value": 1, "tags": {"host": "e"}},
+		  {"metric": "sys.disk", "timestamp": 1030, "value": 3, "tags": {"host": "e"}}]`)
+	for _, e := range puts {
+		if status := post(t, srv, "/api/put", e, nil); status != http.StatusNoContent {
+			t.Fatalf("%v: expected no content for [%v], got [%v]", fn, e, status)
+		}
+	}
+
+	var summary map[string]int
+	status := post(t, srv, "/api/put?summary", `{"metric": "sys.mem", "timestamp": 1000, "value": 5}`, &summary)
+	if status != http.StatusOK || summary["success"] != 1 {
+		t.Errorf("%v: expected summary of 1 success, got [%v] [%v]", fn, status, summary)
+	}
+
+	for _, e := range []string{
+		`{"metric": "sys.cpu", "timestamp": 1000}`,
+		`{"timestamp": 1000, "value": 1}`,
+		`[{"metric": "sys.cpu", "timestamp": -1, "value": 1}]`,
+		`not json`,
+	} {
+		if status := post(t, srv, "/api/put", e, nil); status != http.StatusBadRequest {
+			t.Errorf("%v: expected bad request for [%v], got [%v]", fn, e, status)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected []queryResult
+	}{
+		{
+			`{"start": 900, "end": "1030", "queries": [{"aggregator": "sum", "metric": "sys.cpu", "tags": {"dc": "*"}}]}`,
+			[]queryResult{
+				{"sys.cpu", map[string]string{"dc": "east"}, []string{"host"}, map[string]float64{"1000": 11, "1030": 3}},
+				{"sys.cpu", map[string]string{"dc": "west", "host": "c"}, []string{}, map[string]float64{"1000": 100}},
+			},
+		},
+		{
+			`{"start": "3h-ago", "queries": [{"aggregator": "max", "metric": "sys.cpu", "downsample": "1m-avg", "tags": {"host": "a|b"}}]}`,
+			[]queryResult{
+				{"sys.cpu", map[string]string{"dc": "east", "host": "a"}, []string{}, map[string]float64{"960": 1, "1020": 3}},
+				{"sys.cpu", map[string]string{"dc": "east", "host": "b"}, []string{}, map[string]float64{"960": 10}},
+			},
+		},
+		{
+			`{"start": 900, "queries": [{"aggregator": "count", "metric": "sys.cpu"}]}`,
+			[]queryResult{
+				{"sys.cpu", map[string]string{}, []string{"dc", "host"}, map[string]float64{"1000": 3, "1030": 1}},
+			},
+		},
+		// d is interpolated at 1010 and 1030, and e at 1000 and 1020, but
+		// neither out of its own points
+		{
+			`{"start": 900, "queries": [{"aggregator": "sum", "metric": "sys.disk"}]}`,
+			[]queryResult{
+				{"sys.disk", map[string]string{}, []string{"host"}, map[string]float64{"1000": 0, "1010": 11, "1020": 22, "1030": 33, "1040": 40}},
+			},
+		},
+		{
+			`{"start": 900, "queries": [{"aggregator": "avg", "metric": "sys.disk"}]}`,
+			[]queryResult{
+				{"sys.disk", map[string]string{}, []string{"host"}, map[string]float64{"1000": 0, "1010": 5.5, "1020": 11, "1030": 16.5, "1040": 40}},
+			},
+		},
+		{
+			`{"start": 900, "queries": [{"aggregator": "zimsum", "metric": "sys.disk"}]}`,
+			[]queryResult{
+				{"sys.disk", map[string]string{}, []string{"host"}, map[string]float64{"1000": 0, "1010": 1, "1020": 20, "1030": 3, "1040": 40}},
+			},
+		},
+		{
+			`{"start": 900, "queries": [{"aggregator": "mimmax", "metric": "sys.disk"}]}`,
+			[]queryResult{
+				{"sys.disk", map[string]string{}, []string{"host"}, map[string]float64{"1000": 0, "1010": 1, "1020": 20, "1030": 3, "1040": 40}},
+			},
+		},
+	}
+
+	for _, e := range tests {
+		var actual []queryResult
+		status := post(t, srv, "/api/query", e.query, &actual)
+		if status != http.StatusOK || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: [%v]: expected [%+v], got [%v] [%+v]", fn, e.query, e.expected, status, actual)
+		}
+	}
+
+	params := url.Values{"start": {"900"}, "end": {"1000"}, "m": {"sum:sys.cpu{host=a}"}}
+	resp, err := http.Get(srv.URL + "/api/query?" + params.Encode())
+	if err != nil {
+		t.Fatalf("%v: cannot get query, err [%v]", fn, err)
+	}
+	var actual []queryResult
+	err = json.NewDecoder(resp.Body).Decode(&actual)
+	resp.Body.Close()
+	expected := []queryResult{{"sys.cpu", map[string]string{"dc": "east", "host": "a"}, []string{}, map[string]float64{"1000": 1}}}
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%v: %v: expected [%+v], got [%+v], err [%v]", fn, params, expected, actual, err)
+	}
+
+	for _, e := range []string{
+		`{"queries": [{"aggregator": "sum", "metric": "sys.cpu"}]}`,
+		`{"start": 900, "queries": []}`,
+		`{"start": 900, "queries": [{"aggregator": "median", "metric": "sys.cpu"}]}`,
+		`{"start": 900, "queries": [{"aggregator": "sum", "metric": "sys.cpu", "downsample": "1x-avg"}]}`,
+		`{"start": 900, "queries": [{"aggregator": "sum", "metric": "sys.cpu", "downsample": "4294967296s-avg"}]}`,
+		`{"start": 900, "queries": [{"aggregator": "sum", "metric": "sys.cpu", "downsample": "2562047788015216h-avg"}]}`,
+		`{"start": 1000, "end": 900, "queries": [{"aggregator": "sum", "metric": "sys.cpu"}]}`,
+	} {
+		if status := post(t, srv, "/api/query", e, nil); status != http.StatusBadRequest {
+			t.Errorf("%v: expected bad request for [%v], got [%v]", fn, e, status)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	const fn = "TestParseTime"
+
+	now := time.Unix(100000, 0)
+	tests := []struct {
+		str      string
+		expected uint32
+	}{
+		{"1000", 1000},
+		{"1000000000500", 1000000000},
+		{"1h-ago", 100000 - 3600},
+		{"2d-ago", 0},
+		{"1970/01/02", 86400},
+		{"1970/01/02-01:00", 86400 + 3600},
+		{"1970/01/02-01:00:30", 86400 + 3630},
+	}
+
+	for _, e := range tests {
+		actual, err := parseTime(e.str, now)
+		if err != nil || actual != e.expected {
+			t.Errorf("%v: %v: expected [%v], got [%v], err [%v]", fn, e.str, e.expected, actual, err)
+		}
+	}
+
+	for _, e := range []string{"", "1x-ago", "h-ago", "yesterday", "-5", "9223372036854775807m-ago"} {
+		if _, err := parseTime(e, now); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
+
+func TestParseM(t *testing.T) {
+	const fn = "TestParseM"
+
+	tests := []struct {
+		m        string
+		expected subQuery
+	}{
+		{"sum:sys.cpu", subQuery{Aggregator: "sum", Metric: "sys.cpu"}},
+		{"avg:5m-max:sys.cpu{host=*,dc=east}", subQuery{
+			Aggregator: "avg", Downsample: "5m-max", Metric: "sys.cpu",
+			Tags: map[string]string{"host": "*", "dc": "east"},
+		}},
+	}
+
+	for _, e := range tests {
+		actual, err := parseM(e.m)
+		if err != nil || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: %v: expected [%+v], got [%+v], err [%v]", fn, e.m, e.expected, actual, err)
+		}
+	}
+
+	for _, e := range []string{"sys.cpu", "a:b:c:d", "sum:sys.cpu{host}", "sum:sys.cpu{host=a"} {
+		if _, err := parseM(e); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/context"
+)
+
+func main() {
+	var (
+		project      = flag.String("project", "", "The name of the project.")
+		instance     = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile     = flag.String("authjson", "", "Google application credentials json file.")
+		table        = flag.String("table", "sec", "Table of the series.")
+		indexTable   = flag.String("index_table", "", "Series index table to resolve the label matchers of reads.")
+		listen       = flag.String("listen", ":9201", "Address to serve the prometheus remote storage api on.")
+		numReaders   = flag.Int("num_readers", 16, "Number of series of a read to read in parallel.")
+		batcherFlags = btutil.NewBatcherFlags(10, 1000)
+		schemaFlags  = btutil.NewSchemaFlags("sec")
+	)
+
+	//eg: bin/btprom -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec -index_table index
+
+	flag.Parse()
+	if *project == "" || *instance == "" || *authfile == "" || *indexTable == "" || *numReaders <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	client, _ := btutil.Clients(*project, *instance, *authfile)
+	tbl := client.Open(*table)
+	schema := schemaFlags.Schema()
+	index := btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+
+	s := &server{
+		reader:     btread.NewReader(tbl, schema),
+		index:      index,
+		numReaders: *numReaders,
+		batcher:    btutil.NewBatcher(context.Background(), tbl, schema, index, batcherFlags.Config()),
+	}
+
+	log.Printf("serving prometheus remote storage api on [%v]", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s.handler()))
+}
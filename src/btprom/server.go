@@ -0,0 +1,238 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/context"
+)
+
+// server serves the prometheus remote storage api.
+type server struct {
+	reader     *btread.Reader
+	index      *btutil.SeriesIndex
+	numReaders int
+	batcher    *btutil.Batcher
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/read", s.read)
+	mux.HandleFunc("/api/v1/write", s.write)
+	return mux
+}
+
+// name_label is the prometheus label of the name of a series.
+const name_label = "__name__"
+
+var matcherOps = map[prompb.LabelMatcher_Type]string{
+	prompb.LabelMatcher_EQ:  "=",
+	prompb.LabelMatcher_NEQ: "!=",
+	prompb.LabelMatcher_RE:  "=~",
+	prompb.LabelMatcher_NRE: "!~",
+}
+
+// read serves a snappy compressed protobuf prometheus remote read request,
+// answering with samples.
+func (s *server) read(w http.ResponseWriter, r *http.Request) {
+	var req prompb.ReadRequest
+	err := readProto(r, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	matchers := make([][]btutil.Matcher, len(req.Queries))
+	for i, q := range req.Queries {
+		matchers[i], err = queryMatchers(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var resp prompb.ReadResponse
+	for i, q := range req.Queries {
+		result, err := s.query(r.Context(), q, matchers[i])
+		if err != nil {
+			log.Printf("cannot answer remote read query [%v], err [%v]", q, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	data, err := resp.Marshal()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	_, err = w.Write(snappy.Encode(nil, data))
+	if err != nil {
+		log.Printf("cannot write response, err [%v]", err)
+	}
+}
+
+// write serves a snappy compressed protobuf prometheus remote write request.
+// It answers once the samples are written, so that prometheus retries
+// samples that failed.
+func (s *server) write(w http.ResponseWriter, r *http.Request) {
+	var req prompb.WriteRequest
+	err := readProto(r, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := writePoints(req.Timeseries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(points) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = s.batcher.Write(r.Context(), points)
+	if err != nil {
+		log.Printf("cannot write [%v] samples, err [%v]", len(points), err)
+		http.Error(w, err.Error(), btutil.WriteErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePoints returns the points of the samples of timeseries. Timestamps are
+// truncated to seconds. NaN samples, which include the staleness markers of
+// prometheus, are left out.
+func writePoints(timeseries []prompb.TimeSeries) ([]btutil.KeyValueEpochsec, error) {
+	var points []btutil.KeyValueEpochsec
+	for _, ts := range timeseries {
+		labels := make(map[string]string)
+		for _, e := range ts.Labels {
+			labels[e.Name] = e.Value
+		}
+		name, ok := labels[name_label]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("timeseries without %v label [%v]", name_label, ts.Labels))
+		}
+		delete(labels, name_label)
+
+		series := btutil.NewSeries(name, labels)
+		for _, e := range ts.Samples {
+			if math.IsNaN(e.Value) {
+				continue
+			}
+			points = append(points, btutil.KeyValueEpochsec{
+				Series:   series,
+				Value:    e.Value,
+				Epochsec: btutil.Epochsec(e.Timestamp / 1000),
+			})
+		}
+	}
+
+	return points, nil
+}
+
+// queryMatchers returns the matchers of the label matchers of q.
+func queryMatchers(q *prompb.Query) ([]btutil.Matcher, error) {
+	var matchers []btutil.Matcher
+	for _, e := range q.Matchers {
+		op, ok := matcherOps[e.Type]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid label matcher type [%v]", e.Type))
+		}
+
+		m, err := btutil.NewLabelMatcher(e.Name, op, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+// query returns the series matching matchers with their samples in the time
+// range of q.
+func (s *server) query(ctx context.Context, q *prompb.Query, matchers []btutil.Matcher) (*prompb.QueryResult, error) {
+	found, err := btutil.Search(ctx, s.index, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	var seriesList []btutil.Series
+	for _, e := range found {
+		seriesList = append(seriesList, e.Series)
+	}
+
+	// timestamps are in millis, both ends inclusive
+	from, until := btutil.Epochsec((q.StartTimestampMs+999)/1000), btutil.Epochsec(q.EndTimestampMs/1000+1)
+	results, err := s.reader.ReadMany(ctx, seriesList, from, until, s.numReaders)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &prompb.QueryResult{}
+	for i, series := range seriesList {
+		if len(results[i]) == 0 {
+			continue
+		}
+
+		ts := &prompb.TimeSeries{Labels: promLabels(series)}
+		for _, e := range results[i] {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: e.Value, Timestamp: int64(e.Epochsec) * 1000})
+		}
+		result.Timeseries = append(result.Timeseries, ts)
+	}
+
+	return result, nil
+}
+
+// promLabels returns the labels of series with its name in __name__, sorted
+// by name as prometheus expects.
+func promLabels(series btutil.Series) []prompb.Label {
+	labels := []prompb.Label{{Name: name_label, Value: series.Name}}
+	for _, e := range series.Labels {
+		labels = append(labels, prompb.Label{Name: e.Name, Value: e.Value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	return labels
+}
+
+// readProto decodes the snappy compressed protobuf body of r into m.
+func readProto(r *http.Request, m interface{ Unmarshal([]byte) error }) error {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot decode snappy body, err [%v]", err))
+	}
+
+	err = m.Unmarshal(data)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot decode protobuf body, err [%v]", err))
+	}
+
+	return nil
+}
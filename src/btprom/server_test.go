@@ -0,0 +1,182 @@
+package main
+
+import (
+	"btservertest"
+	"btutil"
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// testServer returns a server over an emulator holding the series of ktvs in
+// the hourblob layout, indexed.
+func testServer(t *testing.T, ktvs []btutil.KeyTimevalues) *httptest.Server {
+	f := btservertest.New(t, "hourblob", ktvs)
+	s := &server{
+		reader:     f.Reader,
+		index:      f.Index,
+		numReaders: 4,
+		batcher:    f.Batcher(),
+	}
+
+	return btservertest.Serve(t, s.handler())
+}
+
+// post posts m snappy compressed to path and returns the response status and
+// decompressed body.
+func post(t *testing.T, srv *httptest.Server, path string, m interface{ Marshal() ([]byte, error) }) (int, []byte) {
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal request, err [%v]", err)
+	}
+
+	resp, err := http.Post(srv.URL+path, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatalf("cannot post [%v], err [%v]", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("cannot read response of [%v], err [%v]", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, body
+	}
+
+	body, err = snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("cannot decode response of [%v], err [%v]", path, err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestRead(t *testing.T) {
+	const fn = "TestRead"
+
+	points := []btutil.TimeValue{{Epochsec: 3500, Value: 1}, {Epochsec: 3700, Value: 2}, {Epochsec: 3900, Value: 3}}
+	srv := testServer(t, []btutil.KeyTimevalues{
+		{Series: btutil.NewSeries("cpu", map[string]string{"host": "a", "mode": "user"}), Timevalues: points},
+		{Series: btutil.NewSeries("cpu", map[string]string{"host": "b", "mode": "user"}), Timevalues: points[:1]},
+		{Series: btutil.NewSeries("mem", map[string]string{"host": "a"}), Timevalues: points},
+	})
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{
+		{
+			StartTimestampMs: 3600 * 1000,
+			EndTimestampMs:   3900 * 1000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu"},
+				{Type: prompb.LabelMatcher_RE, Name: "host", Value: "a|b"},
+			},
+		},
+		{
+			StartTimestampMs: 0,
+			EndTimestampMs:   3500 * 1000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "cpu"},
+			},
+		},
+	}}
+
+	status, body := post(t, srv, "/api/v1/read", req)
+	if status != http.StatusOK {
+		t.Fatalf("%v: expected ok, got [%v] [%s]", fn, status, body)
+	}
+
+	var resp prompb.ReadResponse
+	err := resp.Unmarshal(body)
+	if err != nil {
+		t.Fatalf("%v: cannot unmarshal response, err [%v]", fn, err)
+	}
+
+	expected := []*prompb.QueryResult{
+		{Timeseries: []*prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "a"}, {Name: "mode", Value: "user"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 3700 * 1000}, {Value: 3, Timestamp: 3900 * 1000}},
+		}}},
+		{Timeseries: []*prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "mem"}, {Name: "host", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 3500 * 1000}},
+		}}},
+	}
+	if !reflect.DeepEqual(resp.Results, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, resp.Results)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	const fn = "TestWrite"
+
+	srv := testServer(t, nil)
+
+	labels := []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 3600500}, {Value: math.NaN(), Timestamp: 3601000}, {Value: 0, Timestamp: 3602000}},
+	}}}
+	if status, body := post(t, srv, "/api/v1/write", req); status != http.StatusNoContent {
+		t.Fatalf("%v: expected no content, got [%v] [%s]", fn, status, body)
+	}
+
+	read := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   7200 * 1000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"}},
+	}}}
+	status, body := post(t, srv, "/api/v1/read", read)
+	if status != http.StatusOK {
+		t.Fatalf("%v: expected ok, got [%v] [%s]", fn, status, body)
+	}
+
+	var resp prompb.ReadResponse
+	err := resp.Unmarshal(body)
+	if err != nil {
+		t.Fatalf("%v: cannot unmarshal response, err [%v]", fn, err)
+	}
+
+	expected := []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 3600 * 1000}, {Value: 0, Timestamp: 3602 * 1000}},
+	}}}}
+	if !reflect.DeepEqual(resp.Results, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, resp.Results)
+	}
+
+	req = &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "job", Value: "node"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 3600000}},
+	}}}
+	if status, _ := post(t, srv, "/api/v1/write", req); status != http.StatusBadRequest {
+		t.Errorf("%v: expected bad request for a series without name, got [%v]", fn, status)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	const fn = "TestReadInvalid"
+
+	srv := testServer(t, nil)
+
+	resp, err := http.Post(srv.URL+"/api/v1/read", "application/x-protobuf", bytes.NewReader([]byte("not snappy")))
+	if err != nil {
+		t.Fatalf("%v: cannot post, err [%v]", fn, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("%v: expected bad request, got [%v]", fn, resp.StatusCode)
+	}
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "host", Value: "("}},
+	}}}
+	if status, _ := post(t, srv, "/api/v1/read", req); status != http.StatusBadRequest {
+		t.Errorf("%v: expected bad request, got [%v]", fn, status)
+	}
+}
@@ -3,13 +3,12 @@ package main
 import (
 	"flag"
 	"os"
+	"btread"
 	"btutil"
-	"cloud.google.com/go/bigtable"
 	"time"
 	"golang.org/x/net/context"
 	"log"
-	"bytes"
-	"encoding/binary"
+	"strings"
 )
 
 func main() {
@@ -17,59 +16,118 @@ func main() {
 		project   = flag.String("project", "", "The name of the project.")
 		instance  = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
 		authfile = flag.String("authjson", "", "Google application credentials json file.")
-		key = flag.String("key", "", "The key for which to query the data for last 5 min.")
+		key = flag.String("key", "", "The series for which to query the data, as name or name{label=\"value\",...}.")
+		table = flag.String("table", "sec", "Table to query.")
+		indexTable = flag.String("index_table", "", "Series index table to search with -glob, -regex and -tags.")
+		glob = flag.String("glob", "", "Graphite glob of the series names to query, e.g. servers.*.cpu.{user,sys}.")
+		regex = flag.String("regex", "", "Regex of the series to query, matched against name{label=\"value\",...}.")
+		tags = flag.String("tags", "", "Comma separated tag matchers of the series to query, e.g. host=~web.*,dc!=east.")
+		numReaders = flag.Int("num_readers", 16, "Number of series to read in parallel.")
+		fromFlag = flag.Int64("from", 0, "Start of the window in epoch seconds, inclusive. Defaults to 5 min ago.")
+		untilFlag = flag.Int64("until", 0, "End of the window in epoch seconds, exclusive. Defaults to now.")
+		step = flag.Duration("step", 0, "Downsample to one point per step, e.g. 1m. Raw points if 0.")
+		aggFlag = flag.String("agg", "avg", "Aggregation of the points of a step: avg, min, max, sum, count, first, last or pN, e.g. p99.")
+		schemaFlags = btutil.NewSchemaFlags("sec")
 	)
 
 	flag.Parse()
-	if *project == "" || *instance == "" || *authfile == "" || *key == "" {
+	searching := *glob != "" || *regex != "" || *tags != ""
+	if *project == "" || *instance == "" || *authfile == "" || (*key == "") == !searching ||
+		(searching && *indexTable == "") || *numReaders <= 0 || *step < 0 || *step%time.Second != 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	client, _ := btutil.Clients(*project, *instance, *authfile)
-	tbl := client.Open("sec")
+	schema := schemaFlags.Schema()
+	reader := btread.NewReader(client.Open(*table), schema)
 
-	for {
-		start := time.Now()
-		begin := btutil.KeyValueEpochsec{*key, 0, uint32(time.Now().Add(-5 * time.Minute).Unix())}
-		end := btutil.KeyValueEpochsec{*key, 0, uint32(time.Now().Unix())}
-		rr := bigtable.NewRange(begin.BTRowKeyStr(), end.BTRowKeyStr())
-		log.Printf("row range: %v", rr)
+	agg, err := btread.NewAggregator(*aggFlag)
+	if err != nil {
+		log.Fatalf("cannot create aggregator, err [%v]", err)
+	}
 
-		type TimeValue struct {
-			Epochsec uint32
-			Value    float64
+	var seriesList []btutil.Series
+	if searching {
+		matchers, err := searchMatchers(*glob, *regex, *tags)
+		if err != nil {
+			log.Fatalf("cannot create search matchers, err [%v]", err)
 		}
 
-		ctx := context.Background()
-		var results []TimeValue
-		err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
-			epochsec, err := btutil.RowKey(r.Key()).Epochsec()
-			if err != nil {
-				return true
-			}
+		index := btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+		found, err := btutil.Search(context.Background(), index, matchers...)
+		if err != nil {
+			log.Fatalf("cannot search index table [%v], err [%v]", *indexTable, err)
+		}
+		for _, e := range found {
+			seriesList = append(seriesList, e.Series)
+		}
+		log.Printf("search matched [%v] series", len(seriesList))
+	} else {
+		series, err := btutil.ParseSeries(*key)
+		if err != nil {
+			log.Fatalf("cannot parse key [%v], err [%v]", *key, err)
+		}
+		seriesList = append(seriesList, series)
+	}
 
-			var value float64
-			for _, v := range r {
-				for _, e := range v {
-					buf := bytes.NewReader(e.Value)
-					err := binary.Read(buf, binary.BigEndian, &value)
-					if err != nil {
-						log.Printf("got err when converting from []byte to float64 - [%v]", err)
-						return true
-					}
-				}
-			}
+	for {
+		start := time.Now()
+		from := uint32(time.Now().Add(-5 * time.Minute).Unix())
+		if *fromFlag != 0 {
+			from = uint32(*fromFlag)
+		}
+		until := uint32(time.Now().Unix())
+		if *untilFlag != 0 {
+			until = uint32(*untilFlag)
+		}
 
-			results = append(results, TimeValue{epochsec, value})
-			return true
-		})
+		ctx := context.Background()
+		results, err := reader.ReadMany(ctx, seriesList, from, until, *numReaders)
 		if err != nil {
 			log.Fatalf("got err when calling readrows. err [%v]", err)
 		}
 
-		log.Printf("results: %v", results)
-		log.Printf("results obtained in [%v]", time.Since(start))
+		if *step != 0 {
+			for i := range results {
+				results[i] = btread.Downsample(results[i], uint32(*step/time.Second), agg)
+			}
+		}
+
+		for i, series := range seriesList {
+			log.Printf("results for [%v]: %v", series, results[i])
+		}
+		log.Printf("results of [%v] series obtained in [%v]", len(seriesList), time.Since(start))
 		time.Sleep(time.Second * 5)
 	}
 }
+
+// searchMatchers returns the matchers of the -glob, -regex and -tags flags.
+func searchMatchers(glob, regex, tags string) ([]btutil.Matcher, error) {
+	var matchers []btutil.Matcher
+	if glob != "" {
+		m, err := btutil.NewGlobMatcher(glob)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if regex != "" {
+		m, err := btutil.NewRegexMatcher(regex)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if tags != "" {
+		for _, e := range strings.Split(tags, ",") {
+			m, err := btutil.NewTagMatcher(e)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+		}
+	}
+
+	return matchers, nil
+}
@@ -0,0 +1,103 @@
+package btread
+
+import (
+	"btutil"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aggregator reduces the values of a step, in time order, to one value.
+type Aggregator func(values []float64) float64
+
+var aggregators = map[string]Aggregator{
+	"avg": func(values []float64) float64 {
+		return sum(values) / float64(len(values))
+	},
+	"min": func(values []float64) float64 {
+		min := values[0]
+		for _, e := range values[1:] {
+			min = math.Min(min, e)
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := values[0]
+		for _, e := range values[1:] {
+			max = math.Max(max, e)
+		}
+		return max
+	},
+	"sum": sum,
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+	"first": func(values []float64) float64 {
+		return values[0]
+	},
+	"last": func(values []float64) float64 {
+		return values[len(values)-1]
+	},
+}
+
+func sum(values []float64) float64 {
+	var sum float64
+	for _, e := range values {
+		sum += e
+	}
+	return sum
+}
+
+// NewAggregator returns the aggregator of name, one of avg, min, max, sum,
+// count, first, last or pN for the Nth percentile, e.g. p50 or p99.9.
+func NewAggregator(name string) (Aggregator, error) {
+	if agg, ok := aggregators[name]; ok {
+		return agg, nil
+	}
+
+	if strings.HasPrefix(name, "p") {
+		pct, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && pct >= 0 && pct <= 100 {
+			return percentile(pct), nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("invalid aggregation [%v]. should be one of avg, min, max, sum, count, "+
+		"first, last or pN, e.g. p99", name))
+}
+
+// percentile returns the aggregator of the pct percentile by the nearest rank.
+func percentile(pct float64) Aggregator {
+	return func(values []float64) float64 {
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+
+		rank := int(math.Ceil(pct / 100 * float64(len(sorted))))
+		if rank < 1 {
+			rank = 1
+		}
+		return sorted[rank-1]
+	}
+}
+
+// Downsample aggregates points, sorted by time, into one point per step
+// seconds, at the start of the step. Steps are aligned to multiples of step
+// since the epoch and steps without points are left out.
+func Downsample(points []btutil.TimeValue, step uint32, agg Aggregator) []btutil.TimeValue {
+	var result []btutil.TimeValue
+	var values []float64
+	for i, e := range points {
+		values = append(values, e.Value)
+
+		start := e.Epochsec - e.Epochsec%step
+		if i+1 == len(points) || points[i+1].Epochsec-points[i+1].Epochsec%step != start {
+			result = append(result, btutil.TimeValue{Epochsec: start, Value: agg(values)})
+			values = values[:0]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,64 @@
+package btread
+
+import (
+	"btutil"
+	"reflect"
+	"testing"
+)
+
+func TestDownsample(t *testing.T) {
+	const fn = "TestDownsample"
+
+	points := []btutil.TimeValue{
+		{Epochsec: 60, Value: 4},
+		{Epochsec: 70, Value: 1},
+		{Epochsec: 119, Value: 7},
+		{Epochsec: 120, Value: 2},
+		{Epochsec: 300, Value: 5},
+		{Epochsec: 310, Value: 3},
+	}
+
+	tests := []struct {
+		agg      string
+		expected []float64
+	}{
+		{"avg", []float64{4, 2, 4}},
+		{"min", []float64{1, 2, 3}},
+		{"max", []float64{7, 2, 5}},
+		{"sum", []float64{12, 2, 8}},
+		{"count", []float64{3, 1, 2}},
+		{"first", []float64{4, 2, 5}},
+		{"last", []float64{7, 2, 3}},
+		{"p50", []float64{4, 2, 3}},
+		{"p100", []float64{7, 2, 5}},
+		{"p0", []float64{1, 2, 3}},
+	}
+
+	for _, e := range tests {
+		agg, err := NewAggregator(e.agg)
+		if err != nil {
+			t.Errorf("%v: cannot create aggregator [%v], err [%v]", fn, e.agg, err)
+			continue
+		}
+
+		var expected []btutil.TimeValue
+		for i, start := range []uint32{60, 120, 300} {
+			expected = append(expected, btutil.TimeValue{Epochsec: start, Value: e.expected[i]})
+		}
+
+		actual := Downsample(points, 60, agg)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%v: %v: expected [%v], got [%v]", fn, e.agg, expected, actual)
+		}
+	}
+
+	for _, e := range []string{"median", "p", "p101", "pxx"} {
+		if _, err := NewAggregator(e); err == nil {
+			t.Errorf("%v: expected error for aggregation [%v]", fn, e)
+		}
+	}
+
+	if actual := Downsample(nil, 60, aggregators["avg"]); len(actual) != 0 {
+		t.Errorf("%v: expected no points, got [%v]", fn, actual)
+	}
+}
@@ -0,0 +1,106 @@
+// Package btread reads the points of series from tables written by the
+// btutil row key schemas.
+package btread
+
+import (
+	"btutil"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// Reader reads series from a table laid out by a schema.
+type Reader struct {
+	tbl    *bigtable.Table
+	schema btutil.RowKeySchema
+}
+
+// NewReader returns a reader of the series in tbl laid out by schema.
+func NewReader(tbl *bigtable.Table, schema btutil.RowKeySchema) *Reader {
+	return &Reader{tbl, schema}
+}
+
+// Schema returns the schema of the table read.
+func (r *Reader) Schema() btutil.RowKeySchema {
+	return r.schema
+}
+
+// Read returns the points of series in [from, until), sorted by time. The row
+// ranges of the series, one per salt bucket, are read concurrently. A row that
+// cannot be decoded fails the read.
+func (r *Reader) Read(ctx context.Context, series btutil.Series, from, until uint32) ([]btutil.TimeValue, error) {
+	ranges := r.schema.RowRanges(series, from, until)
+	results := make([][]btutil.TimeValue, len(ranges))
+	errs := make([]error, len(ranges))
+
+	var wg sync.WaitGroup
+	for i, rr := range ranges {
+		wg.Add(1)
+		go func(i int, rr bigtable.RowRange) {
+			defer wg.Done()
+
+			var decodeErr error
+			err := r.tbl.ReadRows(ctx, rr, func(row bigtable.Row) bool {
+				points, err := r.schema.Points(series, row)
+				if err != nil {
+					decodeErr = errors.New(fmt.Sprintf("cannot decode row [%v] of series [%v], err [%v]",
+						row.Key(), series, err))
+					return false
+				}
+
+				// rows of the hour layouts also hold points outside the window
+				results[i] = append(results[i], btutil.FilterWindow(points, from, until)...)
+				return true
+			}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+			if err == nil {
+				err = decodeErr
+			}
+			errs[i] = err
+		}(i, rr)
+	}
+	wg.Wait()
+
+	var merged []btutil.TimeValue
+	for i := range ranges {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		merged = append(merged, results[i]...)
+	}
+
+	return btutil.MergePoints(merged), nil
+}
+
+// ReadMany reads the points of each series in [from, until), parallelism series
+// at a time. results[i] are the points of seriesList[i]. The first error of any
+// series fails the read.
+func (r *Reader) ReadMany(ctx context.Context, seriesList []btutil.Series, from, until uint32,
+	parallelism int) ([][]btutil.TimeValue, error) {
+
+	results := make([][]btutil.TimeValue, len(seriesList))
+	errs := make([]error, len(seriesList))
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	for i, series := range seriesList {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, series btutil.Series) {
+			defer func() { <-sem; wg.Done() }()
+
+			results[i], errs[i] = r.Read(ctx, series, from, until)
+		}(i, series)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,83 @@
+package btread
+
+import (
+	"btemulator"
+	"btutil"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// write writes ktv to tbl laid out by schema.
+func write(t *testing.T, tbl *bigtable.Table, schema btutil.RowKeySchema, ktv btutil.KeyTimevalues) {
+	keys, muts := schema.Mutations(ktv)
+	errs, err := tbl.ApplyBulk(context.Background(), keys, muts)
+	if err != nil || errs != nil {
+		t.Fatalf("cannot write [%v], err [%v], errs [%v]", ktv.Series, err, errs)
+	}
+}
+
+func TestRead(t *testing.T) {
+	const fn = "TestRead"
+
+	ctx := context.Background()
+	a := btutil.NewSeries("cpu", map[string]string{"host": "a"})
+	b := btutil.NewSeries("cpu", map[string]string{"host": "b"})
+	points := []btutil.TimeValue{
+		{Epochsec: 7100, Value: 1},
+		{Epochsec: 7200, Value: 2},
+		{Epochsec: 10900, Value: 3},
+		{Epochsec: 11000, Value: 4},
+	}
+
+	for _, layout := range []string{"sec", "hourcol", "hourblob", "hourgorilla"} {
+		schema, err := btutil.NewSchema(layout, btutil.KeyFormat{SaltBuckets: 4})
+		if err != nil {
+			t.Fatalf("%v: cannot create schema [%v], err [%v]", fn, layout, err)
+		}
+
+		tbl := btemulator.Table(t, layout)
+		write(t, tbl, schema, btutil.KeyTimevalues{Series: a, Timevalues: points})
+		write(t, tbl, schema, btutil.KeyTimevalues{Series: b, Timevalues: points[:1]})
+
+		reader := NewReader(tbl, schema)
+		actual, err := reader.Read(ctx, a, 7200, 11000)
+		if err != nil || !reflect.DeepEqual(actual, points[1:3]) {
+			t.Errorf("%v: %v: expected [%v], got [%v], err [%v]", fn, layout, points[1:3], actual, err)
+		}
+
+		many, err := reader.ReadMany(ctx, []btutil.Series{a, b}, 0, 20000, 2)
+		expected := [][]btutil.TimeValue{points, points[:1]}
+		if err != nil || !reflect.DeepEqual(many, expected) {
+			t.Errorf("%v: %v: expected [%v], got [%v], err [%v]", fn, layout, expected, many, err)
+		}
+	}
+}
+
+func TestReadDecodeError(t *testing.T) {
+	const fn = "TestReadDecodeError"
+
+	schema, err := btutil.NewSchema("sec", btutil.KeyFormat{})
+	if err != nil {
+		t.Fatalf("%v: cannot create schema, err [%v]", fn, err)
+	}
+
+	tbl := btemulator.Table(t, "sec")
+	series := btutil.Series{Name: "key_1"}
+	keys, _ := schema.Mutations(btutil.KeyTimevalues{Series: series, Timevalues: []btutil.TimeValue{{Epochsec: 1000, Value: 1}}})
+
+	// a value too short for a float64
+	mut := bigtable.NewMutation()
+	mut.Set("0", "0", 0, []byte{1})
+	err = tbl.Apply(context.Background(), keys[0], mut)
+	if err != nil {
+		t.Fatalf("%v: cannot write row, err [%v]", fn, err)
+	}
+
+	_, err = NewReader(tbl, schema).Read(context.Background(), series, 0, 2000)
+	if err == nil {
+		t.Errorf("%v: expected decode error", fn)
+	}
+}
@@ -1,22 +1,20 @@
 package main
 
 import (
+	"btread"
 	"btutil"
-	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
-	"cloud.google.com/go/bigtable"
 	"golang.org/x/net/context"
 	"sync/atomic"
 )
 
 type queryCondition struct {
-	target      string
+	target      btutil.Series
 	from, until time.Time
 }
 
@@ -31,6 +29,9 @@ func main() {
 		authfile = flag.String("authjson", "", "Google application credentials json file.")
 		qps      = flag.Int("qps", 1000, "queries per second. ")
 		numQueryWorkers = flag.Int("num_query_workers", 100, "queries per second. ")
+		table    = flag.String("table", "sec", "Table to query.")
+		schemaFlags = btutil.NewSchemaFlags("sec")
+		genFlags = btutil.NewBackpressureFlags("gen")
 	)
 
 	//eg: bin/btreadstress  -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -qps 500
@@ -44,23 +45,24 @@ func main() {
 	log.Printf("num query workers: [%v]", *numQueryWorkers)
 
 	client, _ := btutil.Clients(*project, *instance, *authfile)
-	tbl := client.Open("sec")
+	reader := btread.NewReader(client.Open(*table), schemaFlags.Schema())
 
 	ch := make(chan queryCondition, *qps*5)
+	stage := btutil.NewStage[queryCondition]("gen", genFlags.Config())
 
-	go genQueries(*qps, ch)
+	go genQueries(*qps, ch, stage)
 
 	ctx := context.Background()
 	for i := 0; i < *numQueryWorkers; i++ {
-		go queryWorker(ctx, ch, tbl)
+		go queryWorker(ctx, ch, reader)
 	}
 
-	go periodicallyPrintMetrics(ch, *qps)
+	go periodicallyPrintMetrics(ch, *qps, stage)
 
 	select {}
 }
 
-func periodicallyPrintMetrics(ch chan queryCondition, qps int) {
+func periodicallyPrintMetrics(ch chan queryCondition, qps int, stage *btutil.Stage[queryCondition]) {
 	for {
 		n := atomic.LoadUint64(&numQueries)
 		if n != 0 {
@@ -71,50 +73,21 @@ func periodicallyPrintMetrics(ch chan queryCondition, qps int) {
 		} else {
 			log.Printf("no queries yet")
 		}
+		log.Printf("%v", stage)
 
 		time.Sleep(time.Second * 5)
 	}
 }
 
-func queryWorker(ctx context.Context, ch <-chan queryCondition, tbl *bigtable.Table) {
+func queryWorker(ctx context.Context, ch <-chan queryCondition, reader *btread.Reader) {
 	for qc := range ch {
-		query(ctx, qc, tbl)
+		query(ctx, qc, reader)
 	}
 }
 
-func query(ctx context.Context, qc queryCondition, tbl *bigtable.Table) {
+func query(ctx context.Context, qc queryCondition, reader *btread.Reader) {
 	start := time.Now()
-	begin := btutil.KeyValueEpochsec{qc.target, 0, uint32(qc.from.Unix())}
-	end := btutil.KeyValueEpochsec{qc.target, 0, uint32(qc.until.Unix())}
-	rr := bigtable.NewRange(begin.BTRowKeyStr(), end.BTRowKeyStr())
-
-	type TimeValue struct {
-		Epochsec uint32
-		Value    float64
-	}
-	var results []TimeValue
-
-	err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
-		epochsec, err := btutil.RowKey(r.Key()).Epochsec()
-		if err != nil {
-			return true
-		}
-
-		var value float64
-		for _, v := range r {
-			for _, e := range v {
-				buf := bytes.NewReader(e.Value)
-				err := binary.Read(buf, binary.BigEndian, &value)
-				if err != nil {
-					log.Printf("got err when converting from []byte to float64 - [%v]", err)
-					return true
-				}
-			}
-		}
-
-		results = append(results, TimeValue{epochsec, value})
-		return true
-	})
+	results, err := reader.Read(ctx, qc.target, uint32(qc.from.Unix()), uint32(qc.until.Unix()))
 	if err != nil {
 		log.Printf("got err when calling readrows. err [%v]", err)
 		return
@@ -131,17 +104,13 @@ func query(ctx context.Context, qc queryCondition, tbl *bigtable.Table) {
 	}
 }
 
-func genQueries(n int, ch chan<- queryCondition) {
+func genQueries(n int, ch chan queryCondition, stage *btutil.Stage[queryCondition]) {
 
 	for {
 		for i := 0; i < n; i++ {
-			qc := queryCondition{target: getKey(i), from: time.Now().Add(-time.Minute * 5), until: time.Now()}
+			qc := queryCondition{target: btutil.Series{Name: getKey(i)}, from: time.Now().Add(-time.Minute * 5), until: time.Now()}
 
-			select {
-			case ch <- qc:
-			default:
-				log.Fatalf("cannot write to ch. pctFull [%v]", pctFull(ch))
-			}
+			stage.Send(ch, qc)
 		}
 
 		time.Sleep(time.Second * 1)
@@ -151,7 +120,3 @@ func genQueries(n int, ch chan<- queryCondition) {
 func getKey(i int) string {
 	return fmt.Sprintf("key_%v", i)
 }
-
-func pctFull(ch chan<- queryCondition) float64 {
-	return float64(len(ch)) * 100 / float64(cap(ch))
-}
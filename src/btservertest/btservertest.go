@@ -0,0 +1,78 @@
+// Package btservertest sets up the tables behind the servers of the ingestion
+// and query protocols for their tests.
+package btservertest
+
+import (
+	"btemulator"
+	"btread"
+	"btutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// Fixture is a data table and its index in an in-process bigtable emulator.
+type Fixture struct {
+	Schema btutil.RowKeySchema
+	Reader *btread.Reader
+	Index  *btutil.SeriesIndex
+
+	t   testing.TB
+	tbl *bigtable.Table
+}
+
+// New returns a fixture holding the series of ktvs, written in the given
+// layout and indexed.
+func New(t testing.TB, layout string, ktvs []btutil.KeyTimevalues) *Fixture {
+	client := btemulator.Client(t, layout, "index")
+	schema, err := btutil.NewSchema(layout, btutil.KeyFormat{})
+	if err != nil {
+		t.Fatalf("cannot create schema, err [%v]", err)
+	}
+
+	ctx := context.Background()
+	tbl := client.Open(layout)
+	for _, e := range ktvs {
+		keys, muts := schema.Mutations(e)
+		errs, err := tbl.ApplyBulk(ctx, keys, muts)
+		if err != nil || errs != nil {
+			t.Fatalf("cannot write [%v], err [%v], errs [%v]", e.Series, err, errs)
+		}
+	}
+
+	index := btutil.NewSeriesIndex(client.Open("index"), schema.Format())
+	err = index.Update(ctx, ktvs)
+	if err != nil {
+		t.Fatalf("cannot update index, err [%v]", err)
+	}
+
+	return &Fixture{
+		Schema: schema,
+		Reader: btread.NewReader(tbl, schema),
+		Index:  index,
+		t:      t,
+		tbl:    tbl,
+	}
+}
+
+// Batcher returns a batcher writing to the fixture, flushing every 100ms. It
+// is closed when the test ends.
+func (f *Fixture) Batcher() *btutil.Batcher {
+	config := btutil.BatcherConfig{NumWorkers: 2, MaxPoints: 100, MaxAge: 100 * time.Millisecond}
+	b := btutil.NewBatcher(context.Background(), f.tbl, f.Schema, f.Index, config)
+	f.t.Cleanup(b.Close)
+
+	return b
+}
+
+// Serve returns a server of handler, closed when the test ends.
+func Serve(t testing.TB, handler http.Handler) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"btutil"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func main() {
+	var (
+		project       = flag.String("project", "", "The name of the project.")
+		instance      = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile      = flag.String("authjson", "", "Google application credentials json file.")
+		table         = flag.String("table", "", "Table to write metrics.")
+		indexTable    = flag.String("index_table", "", "Table to index the written series in. Empty disables the index.")
+		listen        = flag.String("listen", ":8125", "Udp address to receive statsd metrics on.")
+		flushInterval = flag.Duration("flush_interval", 10*time.Second, "Interval of aggregation of the received metrics.")
+		batcherFlags  = btutil.NewBatcherFlags(10, 1000)
+		schemaFlags   = btutil.NewSchemaFlags("sec")
+	)
+
+	//eg: bin/btstatsd -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec
+
+	flag.Parse()
+	if *project == "" || *instance == "" || *authfile == "" || *table == "" || *flushInterval < time.Second {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	client, _ := btutil.Clients(*project, *instance, *authfile)
+	schema := schemaFlags.Schema()
+
+	var index *btutil.SeriesIndex
+	if *indexTable != "" {
+		index = btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+	}
+
+	ctx := context.Background()
+	batcher := btutil.NewBatcher(ctx, client.Open(*table), schema, index, batcherFlags.Config())
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		log.Fatalf("cannot listen on udp [%v], err [%v]", *listen, err)
+	}
+
+	a := newAggregator()
+	go serveUDP(conn, a)
+
+	log.Printf("receiving statsd metrics on [%v], flush interval [%v]", *listen, *flushInterval)
+	for now := range time.Tick(*flushInterval) {
+		go flush(ctx, a.flush(now), batcher)
+	}
+}
+
+// flush writes the points of a flush interval.
+func flush(ctx context.Context, points []btutil.KeyValueEpochsec, batcher *btutil.Batcher) {
+	if len(points) == 0 {
+		return
+	}
+
+	err := batcher.Write(ctx, points)
+	if err != nil {
+		log.Printf("cannot write [%v] points of flush, err [%v]", len(points), err)
+		return
+	}
+	log.Printf("flushed [%v] points", len(points))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"btread"
+	"btutil"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a parsed statsd line.
+type metric struct {
+	series btutil.Series
+	// kind is the statsd type, c, g, ms, h or s
+	kind  string
+	value float64
+	// str is the raw value, the member of a set
+	str string
+	// delta is whether a gauge value is signed, changing the gauge
+	delta bool
+	rate  float64
+}
+
+// parseLine parses a statsd line, name:value|type[|@rate][|#tag:value,...].
+// Tags, as sent by dogstatsd clients, become the labels of the series.
+func parseLine(line string) (metric, error) {
+	i := strings.LastIndexByte(strings.SplitN(line, "|", 2)[0], ':')
+	if i <= 0 {
+		return metric{}, errors.New(fmt.Sprintf("invalid line [%v]. should be name:value|type", line))
+	}
+
+	fields := strings.Split(line[i+1:], "|")
+	if len(fields) < 2 {
+		return metric{}, errors.New(fmt.Sprintf("missing type in line [%v]", line))
+	}
+
+	m := metric{kind: fields[1], str: fields[0], rate: 1}
+	labels := make(map[string]string)
+	for _, e := range fields[2:] {
+		switch {
+		case strings.HasPrefix(e, "@"):
+			rate, err := strconv.ParseFloat(e[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return metric{}, errors.New(fmt.Sprintf("invalid sample rate in line [%v]", line))
+			}
+			m.rate = rate
+		case strings.HasPrefix(e, "#"):
+			for _, tag := range strings.Split(e[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if kv[0] == "" {
+					return metric{}, errors.New(fmt.Sprintf("invalid tag [%v] in line [%v]", tag, line))
+				}
+				if len(kv) == 1 {
+					kv = append(kv, "")
+				}
+				labels[kv[0]] = kv[1]
+			}
+		default:
+			return metric{}, errors.New(fmt.Sprintf("invalid field [%v] in line [%v]", e, line))
+		}
+	}
+	m.series = btutil.NewSeries(line[:i], labels)
+
+	switch m.kind {
+	case "s":
+		return m, nil
+	case "c", "g", "ms", "h":
+	default:
+		return metric{}, errors.New(fmt.Sprintf("invalid type [%v] in line [%v]", m.kind, line))
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return metric{}, errors.New(fmt.Sprintf("invalid value in line [%v]", line))
+	}
+	m.value = value
+	m.delta = m.kind == "g" && (strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-"))
+
+	return m, nil
+}
+
+// timer holds the values of a timer in a flush interval.
+type timer struct {
+	values []float64
+	// count is the number of values sent, by the sample rates
+	count float64
+}
+
+// aggregator aggregates statsd metrics over a flush interval, by series.
+type aggregator struct {
+	lock     sync.Mutex
+	series   map[string]btutil.Series
+	counters map[string]float64
+	// gauges keep their value across flushes, like statsd does
+	gauges map[string]float64
+	timers map[string]*timer
+	sets   map[string]map[string]bool
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		series:   make(map[string]btutil.Series),
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string]*timer),
+		sets:     make(map[string]map[string]bool),
+	}
+}
+
+func (a *aggregator) add(m metric) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := m.series.String()
+	a.series[key] = m.series
+
+	switch m.kind {
+	case "c":
+		a.counters[key] += m.value / m.rate
+	case "g":
+		if m.delta {
+			a.gauges[key] += m.value
+		} else {
+			a.gauges[key] = m.value
+		}
+	case "ms", "h":
+		t, ok := a.timers[key]
+		if !ok {
+			t = &timer{}
+			a.timers[key] = t
+		}
+		t.values = append(t.values, m.value)
+		t.count += 1 / m.rate
+	case "s":
+		set, ok := a.sets[key]
+		if !ok {
+			set = make(map[string]bool)
+			a.sets[key] = set
+		}
+		set[m.str] = true
+	}
+}
+
+// flush returns the points of the interval ending at now and starts the next
+// interval. Counters are the sum of the interval, gauges their last value,
+// sets their number of unique members and timers the derived series
+// name.mean, name.p90 and name.count.
+func (a *aggregator) flush(now time.Time) []btutil.KeyValueEpochsec {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	epochsec := uint32(now.Unix())
+	var points []btutil.KeyValueEpochsec
+	point := func(series btutil.Series, value float64) {
+		points = append(points, btutil.KeyValueEpochsec{Series: series, Value: value, Epochsec: epochsec})
+	}
+
+	for key, value := range a.counters {
+		point(a.series[key], value)
+	}
+	for key, value := range a.gauges {
+		point(a.series[key], value)
+	}
+	for key, set := range a.sets {
+		point(a.series[key], float64(len(set)))
+	}
+	for key, t := range a.timers {
+		series := a.series[key]
+		point(derived(series, "mean"), mean(t.values))
+		point(derived(series, "p90"), p90(t.values))
+		point(derived(series, "count"), t.count)
+	}
+
+	a.counters = make(map[string]float64)
+	a.timers = make(map[string]*timer)
+	a.sets = make(map[string]map[string]bool)
+	for key := range a.series {
+		if _, ok := a.gauges[key]; !ok {
+			delete(a.series, key)
+		}
+	}
+
+	return points
+}
+
+// derived returns the series of a statistic of series, name.stat with the same labels.
+func derived(series btutil.Series, stat string) btutil.Series {
+	return btutil.Series{Name: series.Name + "." + stat, Labels: series.Labels}
+}
+
+var mean, _ = btread.NewAggregator("avg")
+var p90, _ = btread.NewAggregator("p90")
+
+// serveUDP reads packets of conn, each holding lines, into a until conn is closed.
+func serveUDP(conn net.PacketConn, a *aggregator) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("stopped reading statsd packets, err [%v]", err)
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			m, err := parseLine(line)
+			if err != nil {
+				log.Printf("skipping statsd line, err [%v]", err)
+				continue
+			}
+			a.add(m)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"btservertest"
+	"btutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseLine(t *testing.T) {
+	const fn = "TestParseLine"
+
+	tests := []struct {
+		line     string
+		expected metric
+	}{
+		{"hits:2|c", metric{series: btutil.Series{Name: "hits"}, kind: "c", value: 2, str: "2", rate: 1}},
+		{"hits:1|c|@0.1", metric{series: btutil.Series{Name: "hits"}, kind: "c", value: 1, str: "1", rate: 0.1}},
+		{"temp:-3|g", metric{series: btutil.Series{Name: "temp"}, kind: "g", value: -3, str: "-3", delta: true, rate: 1}},
+		{"req.time:320|ms|@0.5|#host:a,dc:east", metric{
+			series: btutil.NewSeries("req.time", map[string]string{"host": "a", "dc": "east"}),
+			kind:   "ms", value: 320, str: "320", rate: 0.5,
+		}},
+		{"users:alice|s", metric{series: btutil.Series{Name: "users"}, kind: "s", str: "alice", rate: 1}},
+	}
+
+	for _, e := range tests {
+		actual, err := parseLine(e.line)
+		if err != nil || !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%v: [%v]: expected [%+v], got [%+v], err [%v]", fn, e.line, e.expected, actual, err)
+		}
+	}
+
+	for _, e := range []string{"hits", "hits:1", ":1|c", "hits:x|c", "hits:1|q", "hits:1|c|@2", "hits:1|c|x", "hits:1|c|#:a"} {
+		if _, err := parseLine(e); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
+
+func add(t *testing.T, a *aggregator, lines ...string) {
+	for _, e := range lines {
+		m, err := parseLine(e)
+		if err != nil {
+			t.Fatalf("cannot parse [%v], err [%v]", e, err)
+		}
+		a.add(m)
+	}
+}
+
+func values(points []btutil.KeyValueEpochsec) map[string]float64 {
+	result := make(map[string]float64)
+	for _, e := range points {
+		result[e.Series.String()] = e.Value
+	}
+	return result
+}
+
+func TestAggregator(t *testing.T) {
+	const fn = "TestAggregator"
+
+	a := newAggregator()
+	add(t, a,
+		"hits:1|c", "hits:1|c|@0.5",
+		"temp:10|g", "temp:+5|g",
+		"users:alice|s", "users:bob|s", "users:alice|s",
+		"lat:10|ms", "lat:20|ms", "lat:30|ms|@0.5", "lat:40|ms|#host:a",
+	)
+
+	now := time.Unix(1000, 0)
+	points := a.flush(now)
+	expected := map[string]float64{
+		"hits":                3,
+		"temp":                15,
+		"users":               2,
+		"lat.mean":            20,
+		"lat.p90":             30,
+		"lat.count":           4,
+		`lat.mean{host="a"}`:  40,
+		`lat.p90{host="a"}`:   40,
+		`lat.count{host="a"}`: 1,
+	}
+	if actual := values(points); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, actual)
+	}
+	for _, e := range points {
+		if e.Epochsec != 1000 {
+			t.Errorf("%v: expected points at flush time, got [%+v]", fn, e)
+		}
+	}
+
+	// only gauges outlive a flush
+	add(t, a, "temp:-1|g")
+	expected = map[string]float64{"temp": 14}
+	if actual := values(a.flush(now)); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, actual)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	const fn = "TestFlush"
+
+	ctx := context.Background()
+	f := btservertest.New(t, "sec", nil)
+	batcher := f.Batcher()
+
+	a := newAggregator()
+	add(t, a, "lat:10|ms", "lat:30|ms")
+	flush(ctx, a.flush(time.Unix(1000, 0)), batcher)
+
+	reader := f.Reader
+	var actual []float64
+	for _, e := range []string{"lat.count", "lat.mean", "lat.p90"} {
+		points, err := reader.Read(ctx, btutil.Series{Name: e}, 1000, 1001)
+		if err != nil || len(points) != 1 {
+			t.Fatalf("%v: expected a point of [%v], got [%v], err [%v]", fn, e, points, err)
+		}
+		actual = append(actual, points[0].Value)
+	}
+	expected := []float64{2, 20, 30}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, actual)
+	}
+}
@@ -0,0 +1,173 @@
+package btutil
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync/atomic"
+)
+
+// BackpressurePolicy is what a pipeline stage does with an item when the
+// channel to the next stage is full.
+type BackpressurePolicy int
+
+const (
+	// Block waits until the channel has room.
+	Block BackpressurePolicy = iota
+	// DropNewest drops the item.
+	DropNewest
+	// DropOldest drops the oldest item in the channel to make room. Items
+	// sent to an unbuffered channel have nothing older and are dropped.
+	DropOldest
+	// Shed drops items with a probability rising with the fill of the
+	// channel, and waits like Block if the channel is full anyway.
+	Shed
+)
+
+var backpressureNames = []string{"block", "drop_newest", "drop_oldest", "shed"}
+
+// ParseBackpressurePolicy returns the policy with the given name.
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	for i, e := range backpressureNames {
+		if e == name {
+			return BackpressurePolicy(i), nil
+		}
+	}
+
+	return Block, errors.New(fmt.Sprintf("unknown backpressure policy [%v]. should be one of block, drop_newest, drop_oldest, shed", name))
+}
+
+func (p BackpressurePolicy) String() string {
+	if p < 0 || int(p) >= len(backpressureNames) {
+		return fmt.Sprintf("BackpressurePolicy(%d)", int(p))
+	}
+	return backpressureNames[p]
+}
+
+// BackpressureConfig configures the backpressure of a Stage. The zero value blocks.
+type BackpressureConfig struct {
+	Policy BackpressurePolicy
+	// ShedAbove is the fill of the channel, from 0 to 1, from which Shed drops items.
+	ShedAbove float64
+}
+
+// Stage sends the items of a pipeline stage to the channel to the next stage
+// under a backpressure policy, counting the items sent and dropped.
+type Stage[T any] struct {
+	name   string
+	config BackpressureConfig
+
+	numSent, numDropped, numBlocked uint64
+}
+
+// NewStage returns the stage with the given name and backpressure.
+func NewStage[T any](name string, config BackpressureConfig) *Stage[T] {
+	return &Stage[T]{name: name, config: config}
+}
+
+// Send sends item to ch, applying the policy of the stage if ch is full. It
+// returns the items dropped: item itself, or with DropOldest the items taken
+// out of ch to make room, for the caller to release them.
+func (s *Stage[T]) Send(ch chan T, item T) []T {
+	if !s.admit(len(ch), cap(ch)) {
+		atomic.AddUint64(&s.numDropped, 1)
+		return []T{item}
+	}
+
+	var dropped []T
+	for {
+		select {
+		case ch <- item:
+			atomic.AddUint64(&s.numSent, 1)
+			return dropped
+		default:
+		}
+
+		switch {
+		case s.config.Policy == DropNewest || (s.config.Policy == DropOldest && cap(ch) == 0):
+			atomic.AddUint64(&s.numDropped, 1)
+			return append(dropped, item)
+		case s.config.Policy == DropOldest:
+			select {
+			case old := <-ch:
+				atomic.AddUint64(&s.numDropped, 1)
+				dropped = append(dropped, old)
+			default:
+			}
+		default:
+			atomic.AddUint64(&s.numBlocked, 1)
+			ch <- item
+			atomic.AddUint64(&s.numSent, 1)
+			return dropped
+		}
+	}
+}
+
+// admit returns whether an item should be sent to a channel holding length of
+// capacity items. Only Shed drops items here: the probability rises linearly
+// from 0 at ShedAbove full to 1 when full.
+func (s *Stage[T]) admit(length, capacity int) bool {
+	if s.config.Policy != Shed || capacity == 0 {
+		return true
+	}
+
+	fill := float64(length) / float64(capacity)
+	if fill < s.config.ShedAbove {
+		return true
+	}
+	return fill < 1 && rand.Float64() >= (fill-s.config.ShedAbove)/(1-s.config.ShedAbove)
+}
+
+// NumSent returns the number of items sent.
+func (s *Stage[T]) NumSent() uint64 {
+	return atomic.LoadUint64(&s.numSent)
+}
+
+// NumDropped returns the number of items dropped.
+func (s *Stage[T]) NumDropped() uint64 {
+	return atomic.LoadUint64(&s.numDropped)
+}
+
+// NumBlocked returns the number of sends that had to wait.
+func (s *Stage[T]) NumBlocked() uint64 {
+	return atomic.LoadUint64(&s.numBlocked)
+}
+
+func (s *Stage[T]) String() string {
+	return fmt.Sprintf("stage [%v] policy [%v] sent/dropped/blocked: %v/%v/%v",
+		s.name, s.config.Policy, s.NumSent(), s.NumDropped(), s.NumBlocked())
+}
+
+// BackpressureFlags holds the command line flags configuring the backpressure of a stage.
+type BackpressureFlags struct {
+	name      string
+	policy    *string
+	shedAbove *float64
+}
+
+// NewBackpressureFlags registers the backpressure flags of the stage with the
+// given name, prefixed by it. It must be called before flag.Parse.
+func NewBackpressureFlags(name string) *BackpressureFlags {
+	return &BackpressureFlags{
+		name: name,
+		policy: flag.String(name+"_backpressure", "block",
+			"What the "+name+" stage does when its channel is full: block, drop_newest, drop_oldest or shed."),
+		shedAbove: flag.Float64(name+"_shed_above", 0.8,
+			"Fill of the channel of the "+name+" stage, from 0 to 1, from which shed drops items."),
+	}
+}
+
+// Config returns the backpressure of the parsed flags. It exits if the flags are invalid.
+func (f *BackpressureFlags) Config() BackpressureConfig {
+	policy, err := ParseBackpressurePolicy(*f.policy)
+	if err != nil {
+		log.Fatalf("invalid backpressure of stage [%v], err [%v]", f.name, err)
+	}
+	if *f.shedAbove < 0 || *f.shedAbove >= 1 {
+		log.Fatalf("invalid shed fill [%v] of stage [%v]. should be in [0, 1)", *f.shedAbove, f.name)
+	}
+
+	return BackpressureConfig{Policy: policy, ShedAbove: *f.shedAbove}
+}
@@ -0,0 +1,110 @@
+package btutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	const fn = "TestParseBackpressurePolicy"
+
+	for _, e := range []BackpressurePolicy{Block, DropNewest, DropOldest, Shed} {
+		actual, err := ParseBackpressurePolicy(e.String())
+		if err != nil || actual != e {
+			t.Errorf("%v: parsed [%v] as [%v], err [%v]", fn, e, actual, err)
+		}
+	}
+
+	_, err := ParseBackpressurePolicy("drop")
+	if err == nil {
+		t.Errorf("%v: expected error parsing unknown policy", fn)
+	}
+}
+
+func TestStageAdmit(t *testing.T) {
+	const fn = "TestStageAdmit"
+
+	tests := []struct {
+		policy BackpressurePolicy
+		length int
+		// min and max are the bounds of the number of items of 1000 admitted
+		min, max int
+	}{
+		{Block, 100, 1000, 1000},
+		{DropNewest, 100, 1000, 1000},
+		{Shed, 0, 1000, 1000},
+		{Shed, 50, 1000, 1000},
+		{Shed, 75, 400, 600},
+		{Shed, 100, 0, 0},
+	}
+
+	for _, test := range tests {
+		stage := NewStage[int]("test", BackpressureConfig{test.policy, 0.5})
+		var admitted int
+		for i := 0; i < 1000; i++ {
+			if stage.admit(test.length, 100) {
+				admitted++
+			}
+		}
+		if admitted < test.min || admitted > test.max {
+			t.Errorf("%v: [%v] at [%v] of 100 admitted [%v] of 1000 items, expected in [%v, %v]",
+				fn, test.policy, test.length, admitted, test.min, test.max)
+		}
+	}
+}
+
+func TestStageSend(t *testing.T) {
+	const fn = "TestStageSend"
+
+	tests := []struct {
+		policy   BackpressurePolicy
+		capacity int
+		// left are the items left in the channel after sending 0 to 4
+		left                []int
+		dropped             []int
+		numSent, numDropped uint64
+	}{
+		{DropNewest, 2, []int{0, 1}, []int{2, 3, 4}, 2, 3},
+		{DropOldest, 2, []int{3, 4}, []int{0, 1, 2}, 5, 3},
+		{DropOldest, 0, nil, []int{0, 1, 2, 3, 4}, 0, 5},
+		{Shed, 2, []int{0, 1}, []int{2, 3, 4}, 2, 3},
+	}
+
+	for _, test := range tests {
+		ch := make(chan int, test.capacity)
+		stage := NewStage[int]("test", BackpressureConfig{test.policy, 0.5})
+		var dropped []int
+		for i := 0; i < 5; i++ {
+			dropped = append(dropped, stage.Send(ch, i)...)
+		}
+		close(ch)
+
+		var left []int
+		for e := range ch {
+			left = append(left, e)
+		}
+		if !reflect.DeepEqual(left, test.left) || !reflect.DeepEqual(dropped, test.dropped) {
+			t.Errorf("%v: [%v] of [%v] left [%v] and dropped [%v], expected [%v] and [%v]",
+				fn, test.policy, test.capacity, left, dropped, test.left, test.dropped)
+		}
+		if stage.NumSent() != test.numSent || stage.NumDropped() != test.numDropped {
+			t.Errorf("%v: [%v] of [%v] counted [%v] sent and [%v] dropped, expected [%v] and [%v]",
+				fn, test.policy, test.capacity, stage.NumSent(), stage.NumDropped(), test.numSent, test.numDropped)
+		}
+	}
+
+	// blocking sends wait for room
+	ch := make(chan int, 1)
+	stage := NewStage[int]("test", BackpressureConfig{})
+	stage.Send(ch, 0)
+	go func() {
+		// receive once the send is blocked
+		waitFor(func() bool { return stage.NumBlocked() == 1 })
+		<-ch
+	}()
+	dropped := stage.Send(ch, 1)
+	if len(dropped) != 0 || <-ch != 1 || stage.NumBlocked() != 1 || stage.NumSent() != 2 {
+		t.Errorf("%v: blocking send dropped [%v], counted [%v] blocked and [%v] sent. expected 1 blocked and 2 sent",
+			fn, dropped, stage.NumBlocked(), stage.NumSent())
+	}
+}
@@ -0,0 +1,524 @@
+package btutil
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// BatcherConfig configures a Batcher.
+type BatcherConfig struct {
+	// NumWorkers is the number of goroutines writing batches concurrently.
+	NumWorkers int
+	// MaxPoints flushes a batch once it holds this many points.
+	MaxPoints int
+	// MaxBytes flushes a batch once its estimated size reaches this many bytes. 0 is no limit.
+	MaxBytes int
+	// MaxAge flushes a batch this long after its first point was added.
+	MaxAge time.Duration
+	// Retry is how rows failing with retryable errors are written again.
+	Retry RetryPolicy
+	// DeadLetter, if not nil, is given the rows of a batch that could not be
+	// written. They are logged otherwise.
+	DeadLetter func(rows []FailedRow)
+	// Spool, if not nil, keeps the points of rows still failing with
+	// retryable errors after their retries, instead of reporting them as dead
+	// letters. They are replayed every ReplayInterval.
+	Spool          *Spool
+	ReplayInterval time.Duration
+	// AckSpooled reports a batch spooled as written, nil instead of
+	// ErrSpooled. Its points may then be lost if the spool is.
+	AckSpooled bool
+	// Backpressure is what Add does with a full batch when the queue of
+	// NumWorkers batches waiting for a free worker is full.
+	Backpressure BackpressureConfig
+}
+
+// ErrSpooled is the result of writing a batch with rows that were not
+// written to the table but spooled, to be written later.
+var ErrSpooled = errors.New("rows spooled to write later, not written yet")
+
+// ErrDropped is the result of writing a batch dropped by the backpressure of
+// the batcher.
+var ErrDropped = errors.New("batch dropped, too many batches waiting to be written")
+
+// WriteErrorStatus returns the http status to reply with when a write fails
+// with err: 503 for ErrSpooled and ErrDropped, as the client may write again
+// later, and 500 otherwise.
+func WriteErrorStatus(err error) int {
+	if err == ErrSpooled || err == ErrDropped {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// pointOverhead is the estimated size of a point besides its series: the
+// value, the time and the column.
+const pointOverhead = 16
+
+// batch is points to write together, with the callbacks of their adds.
+type batch struct {
+	points []KeyValueEpochsec
+	bytes  int
+	start  time.Time
+	dones  []func(error)
+}
+
+// Batcher collects points into batches and writes the batches to a table
+// with ApplyBulk from a pool of workers. A batch is flushed when it reaches
+// MaxPoints or MaxBytes, when it is MaxAge old, or by Flush.
+type Batcher struct {
+	tbl    bulkApplier
+	schema RowKeySchema
+	index  *SeriesIndex
+	config BatcherConfig
+
+	lock    sync.Mutex
+	current *batch
+	batches chan *batch
+	stage   *Stage[*batch]
+	// pending counts the batches handed to the workers and not written yet
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	// replayer waits for the replay of the spool to stop
+	replayer sync.WaitGroup
+	stop     chan struct{}
+
+	// number of points written, of rows that could not be written, of
+	// points spooled and of points dropped
+	numWrites, numDeadLetters, numSpooled, numDropped uint64
+}
+
+// NewBatcher starts the workers of a batcher writing to tbl laid out by
+// schema. Series written are recorded in index if not nil.
+func NewBatcher(ctx context.Context, tbl *bigtable.Table, schema RowKeySchema, index *SeriesIndex,
+	config BatcherConfig) *Batcher {
+
+	return newBatcher(ctx, tbl, schema, index, config)
+}
+
+func newBatcher(ctx context.Context, tbl bulkApplier, schema RowKeySchema, index *SeriesIndex,
+	config BatcherConfig) *Batcher {
+
+	b := &Batcher{
+		tbl:     tbl,
+		schema:  schema,
+		index:   index,
+		config:  config,
+		batches: make(chan *batch, config.NumWorkers),
+		stage:   NewStage[*batch]("batcher", config.Backpressure),
+		stop:    make(chan struct{}),
+	}
+
+	log.Printf("num savers: [%v], batcher config %+v", config.NumWorkers, config)
+	b.workers.Add(config.NumWorkers)
+	for i := 0; i < config.NumWorkers; i++ {
+		go b.worker(ctx)
+	}
+	go b.periodicallyFlushOld()
+	if config.Spool != nil {
+		b.replayer.Add(1)
+		go b.periodicallyReplay(ctx)
+	}
+
+	return b
+}
+
+// Add adds points to the current batch. done, if not nil, is called with the
+// result of writing the batch, nil once all its rows were applied and
+// ErrSpooled if some were spooled instead, unless AckSpooled. When a batch
+// is full and the queue of batches waiting for a free worker too, Add blocks,
+// or drops batches with ErrDropped, as per Backpressure. It must not be
+// called after Close.
+func (b *Batcher) Add(points []KeyValueEpochsec, done func(err error)) {
+	if len(points) == 0 {
+		if done != nil {
+			done(nil)
+		}
+		return
+	}
+
+	b.lock.Lock()
+	if b.current == nil {
+		b.current = &batch{start: time.Now()}
+	}
+	c := b.current
+	c.points = append(c.points, points...)
+	for _, e := range points {
+		c.bytes += len(e.Series.String()) + pointOverhead
+	}
+	if done != nil {
+		c.dones = append(c.dones, done)
+	}
+
+	var full *batch
+	if len(c.points) >= b.config.MaxPoints || (b.config.MaxBytes > 0 && c.bytes >= b.config.MaxBytes) {
+		full = b.take()
+	}
+	b.lock.Unlock()
+
+	b.send(full)
+}
+
+// Write adds points and waits until their batch is written.
+func (b *Batcher) Write(ctx context.Context, points []KeyValueEpochsec) error {
+	ch := make(chan error, 1)
+	b.Add(points, func(err error) { ch <- err })
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush writes the current batch and waits until all batches are written.
+// It waits for room in the queue of batches whatever the Backpressure.
+func (b *Batcher) Flush() {
+	b.lock.Lock()
+	c := b.take()
+	b.lock.Unlock()
+
+	if c != nil {
+		b.batches <- c
+	}
+	b.pending.Wait()
+}
+
+// Close flushes the batcher, stops its workers and the replay of the spool,
+// and closes the spool. Points left in the spool are replayed once it is
+// opened again.
+func (b *Batcher) Close() {
+	close(b.stop)
+	b.Flush()
+	close(b.batches)
+	b.workers.Wait()
+
+	b.replayer.Wait()
+	if b.config.Spool != nil {
+		err := b.config.Spool.Close()
+		if err != nil {
+			log.Printf("cannot close spool, err [%v]", err)
+		}
+	}
+}
+
+// NumWrites returns the number of points written.
+func (b *Batcher) NumWrites() uint64 {
+	return atomic.LoadUint64(&b.numWrites)
+}
+
+// NumDeadLetters returns the number of rows that could not be written.
+func (b *Batcher) NumDeadLetters() uint64 {
+	return atomic.LoadUint64(&b.numDeadLetters)
+}
+
+// NumDropped returns the number of points dropped by the backpressure.
+func (b *Batcher) NumDropped() uint64 {
+	return atomic.LoadUint64(&b.numDropped)
+}
+
+// NumSpooled returns the number of points spooled.
+func (b *Batcher) NumSpooled() uint64 {
+	return atomic.LoadUint64(&b.numSpooled)
+}
+
+// take returns the current batch, nil if there is none, and starts a new one. The
+// lock must be held.
+func (b *Batcher) take() *batch {
+	c := b.current
+	b.current = nil
+	if c != nil {
+		b.pending.Add(1)
+	}
+	return c
+}
+
+// send queues c for the workers, releasing the batches dropped by the backpressure.
+func (b *Batcher) send(c *batch) {
+	if c == nil {
+		return
+	}
+
+	for _, e := range b.stage.Send(b.batches, c) {
+		atomic.AddUint64(&b.numDropped, uint64(len(e.points)))
+		for _, done := range e.dones {
+			done(ErrDropped)
+		}
+		b.pending.Done()
+	}
+}
+
+func (b *Batcher) periodicallyFlushOld() {
+	tick := b.config.MaxAge / 4
+	if tick <= 0 {
+		tick = b.config.MaxAge
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		var old *batch
+		b.lock.Lock()
+		if b.current != nil && time.Since(b.current.start) >= b.config.MaxAge {
+			old = b.take()
+		}
+		b.lock.Unlock()
+
+		b.send(old)
+	}
+}
+
+func (b *Batcher) periodicallyReplay(ctx context.Context) {
+	defer b.replayer.Done()
+
+	ticker := time.NewTicker(b.config.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		if b.config.Spool.Bytes() == 0 {
+			continue
+		}
+		err := b.config.Spool.Replay(func(points []KeyValueEpochsec) error {
+			return b.replay(ctx, points)
+		})
+		if err != nil {
+			log.Printf("stopped replaying spool. err [%v]", err)
+		}
+	}
+}
+
+// replay writes points read back from the spool. It returns an error, to
+// keep the points in the spool, if rows still fail with retryable errors.
+func (b *Batcher) replay(ctx context.Context, points []KeyValueEpochsec) error {
+	failed, retry := b.write(ctx, points)
+	if len(retry) > 0 {
+		return errors.New(fmt.Sprintf("[%v] of [%v] points not written yet", len(retry), len(points)))
+	}
+	b.deadLetter(failed)
+	return nil
+}
+
+func (b *Batcher) worker(ctx context.Context) {
+	defer b.workers.Done()
+
+	for c := range b.batches {
+		err := b.save(ctx, c.points)
+		for _, done := range c.dones {
+			done(err)
+		}
+		b.pending.Done()
+	}
+}
+
+func (b *Batcher) save(ctx context.Context, slice []KeyValueEpochsec) error {
+	failed, retry := b.write(ctx, slice)
+	if len(failed) == 0 {
+		return nil
+	}
+
+	spooled := false
+	if b.config.Spool != nil && len(retry) > 0 {
+		err := b.config.Spool.Append(retry)
+		if err == nil {
+			spooled = true
+			atomic.AddUint64(&b.numSpooled, uint64(len(retry)))
+			var rest []FailedRow
+			for _, e := range failed {
+				if !retryable(e.Err) {
+					rest = append(rest, e)
+				}
+			}
+			failed = rest
+		} else {
+			log.Printf("cannot spool [%v] points. err [%v]", len(retry), err)
+		}
+	}
+
+	if len(failed) == 0 {
+		if spooled && !b.config.AckSpooled {
+			return ErrSpooled
+		}
+		return nil
+	}
+	b.deadLetter(failed)
+	return errors.New(fmt.Sprintf("[%v] rows could not be written, first err [%v]", len(failed), failed[0].Err))
+}
+
+func (b *Batcher) deadLetter(failed []FailedRow) {
+	if len(failed) == 0 {
+		return
+	}
+
+	atomic.AddUint64(&b.numDeadLetters, uint64(len(failed)))
+	if b.config.DeadLetter != nil {
+		b.config.DeadLetter(failed)
+	} else {
+		logDeadLetters(failed)
+	}
+}
+
+// write applies points to the table, updates the index with the series
+// written and counts the points written. It returns the rows that failed and
+// the points of the rows failing with retryable errors.
+func (b *Batcher) write(ctx context.Context, slice []KeyValueEpochsec) ([]FailedRow, []KeyValueEpochsec) {
+	groups := GroupBySeries(slice)
+
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	// group of every row, to index the series with rows written
+	var rowGroups []int
+	for i, e := range groups {
+		keys, ms := b.schema.Mutations(e)
+
+		muts = append(muts, ms...)
+		rowKeys = append(rowKeys, keys...)
+		for range keys {
+			rowGroups = append(rowGroups, i)
+		}
+	}
+
+	failed := applyWithRetry(ctx, b.tbl, b.config.Retry, rowKeys, muts)
+
+	failedKeys := make(map[string]error)
+	for _, e := range failed {
+		failedKeys[e.RowKey] = e.Err
+	}
+	written := make(map[int]bool)
+	failedGroups := make(map[int]bool)
+	for i, e := range rowKeys {
+		if _, ok := failedKeys[e]; ok {
+			failedGroups[rowGroups[i]] = true
+		} else {
+			written[rowGroups[i]] = true
+		}
+	}
+
+	var writtenGroups []KeyTimevalues
+	var retry []KeyValueEpochsec
+	var numWritten int
+	for i, e := range groups {
+		if written[i] {
+			writtenGroups = append(writtenGroups, e)
+		}
+		if !failedGroups[i] {
+			numWritten += len(e.Timevalues)
+			continue
+		}
+
+		// the points of rows written count, and those of rows failing with
+		// retryable errors are retried
+		for _, tv := range e.Timevalues {
+			err, ok := failedKeys[b.schema.RowKey(e.Series, tv.Epochsec)]
+			switch {
+			case !ok:
+				numWritten++
+			case retryable(err):
+				retry = append(retry, KeyValueEpochsec{e.Series, tv.Value, tv.Epochsec})
+			}
+		}
+	}
+	atomic.AddUint64(&b.numWrites, uint64(numWritten))
+
+	err := b.index.Update(ctx, writtenGroups)
+	if err != nil {
+		log.Printf("cannot update series index. err [%v]", err)
+	}
+
+	return failed, retry
+}
+
+// BatcherFlags holds the command line flags configuring a Batcher.
+type BatcherFlags struct {
+	numWorkers     *int
+	maxPoints      *int
+	maxBytes       *int
+	maxAge         *time.Duration
+	maxAttempts    *int
+	initialBackoff *time.Duration
+	maxBackoff     *time.Duration
+	spoolDir       *string
+	spoolMaxBytes  *int64
+	segmentBytes   *int64
+	replayInterval *time.Duration
+	ackSpooled     *bool
+	backpressure   *BackpressureFlags
+}
+
+// NewBatcherFlags registers the batcher flags. It must be called before flag.Parse.
+func NewBatcherFlags(defaultNumWorkers, defaultMaxPoints int) *BatcherFlags {
+	return &BatcherFlags{
+		numWorkers: flag.Int("num_writers", defaultNumWorkers, "num saving goroutines"),
+		maxPoints:  flag.Int("write_batch_size", defaultMaxPoints, "write batch size"),
+		maxBytes:   flag.Int("write_batch_bytes", 0, "Flush a write batch at this many estimated bytes. 0 is no limit."),
+		maxAge:     flag.Duration("write_batch_age", time.Second, "Flush a write batch this long after its first point."),
+		maxAttempts: flag.Int("write_max_attempts", 5,
+			"Writes of a row failing with retryable errors before it is reported as a dead letter."),
+		initialBackoff: flag.Duration("write_initial_backoff", 100*time.Millisecond, "Longest wait before the first retry of failed rows."),
+		maxBackoff:     flag.Duration("write_max_backoff", 10*time.Second, "Longest wait between retries of failed rows."),
+		spoolDir: flag.String("spool_dir", "",
+			"Directory to spool points of rows failing after their retries, to write them again later. Empty disables the spool."),
+		spoolMaxBytes:  flag.Int64("spool_max_bytes", 1<<30, "Largest size of the spool on disk."),
+		segmentBytes:   flag.Int64("spool_segment_bytes", 64<<20, "Largest size of a segment file of the spool."),
+		replayInterval: flag.Duration("spool_replay_interval", 10*time.Second, "Interval between replays of the spool."),
+		ackSpooled: flag.Bool("spool_ack", false,
+			"Acknowledge writes once spooled, before they are written to the table. Otherwise they fail with 503 to be retried."),
+		backpressure: NewBackpressureFlags("write"),
+	}
+}
+
+// Config returns the config of the parsed flags. It exits if the flags are invalid.
+func (f *BatcherFlags) Config() BatcherConfig {
+	config := BatcherConfig{
+		NumWorkers: *f.numWorkers,
+		MaxPoints:  *f.maxPoints,
+		MaxBytes:   *f.maxBytes,
+		MaxAge:     *f.maxAge,
+		Retry: RetryPolicy{
+			MaxAttempts:    *f.maxAttempts,
+			InitialBackoff: *f.initialBackoff,
+			MaxBackoff:     *f.maxBackoff,
+		},
+		Backpressure: f.backpressure.Config(),
+	}
+	if config.NumWorkers <= 0 || config.MaxPoints <= 0 || config.MaxBytes < 0 || config.MaxAge <= 0 ||
+		config.Retry.MaxAttempts < 0 || config.Retry.InitialBackoff < 0 || config.Retry.MaxBackoff < 0 {
+		log.Fatalf("invalid batcher config %+v", config)
+	}
+
+	if *f.spoolDir != "" {
+		if *f.replayInterval <= 0 {
+			log.Fatalf("invalid spool replay interval [%v]. should be positive", *f.replayInterval)
+		}
+		spool, err := OpenSpool(*f.spoolDir, *f.spoolMaxBytes, *f.segmentBytes)
+		if err != nil {
+			log.Fatalf("cannot open spool [%v], err [%v]", *f.spoolDir, err)
+		}
+		config.Spool = spool
+		config.ReplayInterval = *f.replayInterval
+		config.AckSpooled = *f.ackSpooled
+	}
+
+	return config
+}
@@ -0,0 +1,384 @@
+package btutil
+
+import (
+	"btemulator"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func points(n int) []KeyValueEpochsec {
+	var result []KeyValueEpochsec
+	for i := 0; i < n; i++ {
+		result = append(result, KeyValueEpochsec{Series{Name: "key_1"}, float64(i), uint32(1000 + i)})
+	}
+	return result
+}
+
+// waitFor polls cond until it holds, for at most 10 seconds, and returns whether it held.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestBatcher(t *testing.T) {
+	const fn = "TestBatcher"
+
+	ctx := context.Background()
+	client := btemulator.Client(t, "sec")
+	schema, err := NewSchema("sec", KeyFormat{})
+	if err != nil {
+		t.Fatalf("%v: cannot create schema, err [%v]", fn, err)
+	}
+
+	tests := []struct {
+		name   string
+		config BatcherConfig
+		adds   []int
+		// written is the expected number of points written before Close
+		written int
+	}{
+		{"size", BatcherConfig{NumWorkers: 2, MaxPoints: 3, MaxAge: time.Hour}, []int{1, 2, 2, 1}, 6},
+		{"bytes", BatcherConfig{NumWorkers: 2, MaxPoints: 100, MaxBytes: 3 * (5 + pointOverhead), MaxAge: time.Hour}, []int{2, 1, 1}, 3},
+		{"age", BatcherConfig{NumWorkers: 1, MaxPoints: 100, MaxAge: 20 * time.Millisecond}, []int{1, 1}, 2},
+	}
+
+	for _, e := range tests {
+		b := NewBatcher(ctx, client.Open("sec"), schema, nil, e.config)
+
+		var lock sync.Mutex
+		var results []error
+		var wg sync.WaitGroup
+		var total int
+		for _, n := range e.adds {
+			wg.Add(1)
+			b.Add(points(n), func(err error) {
+				lock.Lock()
+				results = append(results, err)
+				lock.Unlock()
+				wg.Done()
+			})
+			total += n
+		}
+
+		waitFor(func() bool { return int(b.NumWrites()) >= e.written })
+		if int(b.NumWrites()) != e.written {
+			t.Errorf("%v: %v: expected [%v] points written before close, got [%v]", fn, e.name, e.written, b.NumWrites())
+		}
+
+		b.Close()
+		wg.Wait()
+		if int(b.NumWrites()) != total {
+			t.Errorf("%v: %v: expected [%v] points written after close, got [%v]", fn, e.name, total, b.NumWrites())
+		}
+		for _, err := range results {
+			if err != nil {
+				t.Errorf("%v: %v: expected no error, got [%v]", fn, e.name, err)
+			}
+		}
+	}
+
+	b := NewBatcher(ctx, client.Open("sec"), schema, nil, BatcherConfig{NumWorkers: 1, MaxPoints: 100, MaxAge: 10 * time.Millisecond})
+	if err := b.Write(ctx, points(2)); err != nil {
+		t.Errorf("%v: cannot write, err [%v]", fn, err)
+	}
+	if err := b.Write(ctx, nil); err != nil {
+		t.Errorf("%v: cannot write no points, err [%v]", fn, err)
+	}
+	b.Close()
+
+	// the callbacks of a batch failing to write get its error
+	b = NewBatcher(ctx, client.Open("missing"), schema, nil, BatcherConfig{NumWorkers: 1, MaxPoints: 100, MaxAge: 10 * time.Millisecond})
+	if err := b.Write(ctx, points(1)); err == nil {
+		t.Errorf("%v: expected error writing to a missing table", fn)
+	}
+	if b.NumWrites() != 0 {
+		t.Errorf("%v: expected no writes, got [%v]", fn, b.NumWrites())
+	}
+	b.Close()
+}
+
+// outageApplier fails all rows as unavailable while down, and records the rows written otherwise.
+type outageApplier struct {
+	lock    sync.Mutex
+	down    bool
+	written []string
+}
+
+func (o *outageApplier) setDown(down bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.down = down
+}
+
+func (o *outageApplier) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation,
+	opts ...bigtable.ApplyOption) ([]error, error) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.down {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	o.written = append(o.written, rowKeys...)
+	return nil, nil
+}
+
+func TestBatcherSpool(t *testing.T) {
+	const fn = "TestBatcherSpool"
+
+	ctx := context.Background()
+	schema, err := NewSchema("sec", KeyFormat{})
+	if err != nil {
+		t.Fatalf("%v: cannot create schema, err [%v]", fn, err)
+	}
+
+	tests := []struct {
+		ackSpooled bool
+		expected   error
+	}{
+		{false, ErrSpooled},
+		{true, nil},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatalf("%v: cannot create dir, err [%v]", fn, err)
+		}
+		defer os.RemoveAll(dir)
+		spool, err := OpenSpool(dir, 1<<20, 1<<20)
+		if err != nil {
+			t.Fatalf("%v: cannot open spool, err [%v]", fn, err)
+		}
+
+		tbl := &outageApplier{down: true}
+		config := BatcherConfig{NumWorkers: 1, MaxPoints: 100, MaxAge: 10 * time.Millisecond,
+			Spool: spool, ReplayInterval: 20 * time.Millisecond, AckSpooled: test.ackSpooled}
+		b := newBatcher(ctx, tbl, schema, nil, config)
+
+		// points failing to write are spooled, and the write fails with
+		// ErrSpooled unless spooled writes are acknowledged
+		if err := b.Write(ctx, points(3)); err != test.expected {
+			t.Errorf("%v: ack [%v]: expected err [%v], got [%v]", fn, test.ackSpooled, test.expected, err)
+		}
+		if b.NumSpooled() != 3 || b.NumWrites() != 0 || b.NumDeadLetters() != 0 || spool.Bytes() == 0 {
+			t.Errorf("%v: ack [%v]: expected 3 points spooled, got [%v] spooled, [%v] written, [%v] dead letters, [%v] spool bytes",
+				fn, test.ackSpooled, b.NumSpooled(), b.NumWrites(), b.NumDeadLetters(), spool.Bytes())
+		}
+
+		// and replayed once writes recover
+		tbl.setDown(false)
+		waitFor(func() bool { return b.NumWrites() == 3 && spool.Bytes() == 0 })
+		tbl.lock.Lock()
+		numRows := len(tbl.written)
+		tbl.lock.Unlock()
+		if b.NumWrites() != 3 || numRows != 3 || spool.Bytes() != 0 {
+			t.Errorf("%v: ack [%v]: expected 3 points replayed, got [%v] written in [%v] rows, [%v] spool bytes",
+				fn, test.ackSpooled, b.NumWrites(), numRows, spool.Bytes())
+		}
+		b.Close()
+	}
+}
+
+// rowFailingApplier fails the given rows as unavailable, and records the rows written.
+type rowFailingApplier struct {
+	failing map[string]bool
+	written []string
+}
+
+func (a *rowFailingApplier) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation,
+	opts ...bigtable.ApplyOption) ([]error, error) {
+
+	errs := make([]error, len(rowKeys))
+	var failed bool
+	for i, e := range rowKeys {
+		if a.failing[e] {
+			errs[i] = status.Error(codes.Unavailable, "unavailable")
+			failed = true
+		} else {
+			a.written = append(a.written, e)
+		}
+	}
+	if !failed {
+		return nil, nil
+	}
+	return errs, nil
+}
+
+func TestBatcherSpoolFailedRows(t *testing.T) {
+	const fn = "TestBatcherSpoolFailedRows"
+
+	ctx := context.Background()
+	schema, _ := NewSchema("sec", KeyFormat{})
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("%v: cannot create dir, err [%v]", fn, err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := OpenSpool(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("%v: cannot open spool, err [%v]", fn, err)
+	}
+
+	// of the rows of a series, only the one failing is spooled
+	tbl := &rowFailingApplier{failing: map[string]bool{schema.RowKey(Series{Name: "key_1"}, 1001): true}}
+	config := BatcherConfig{NumWorkers: 1, MaxPoints: 100, MaxAge: 10 * time.Millisecond,
+		Spool: spool, ReplayInterval: time.Hour, AckSpooled: true}
+	b := newBatcher(ctx, tbl, schema, nil, config)
+	if err := b.Write(ctx, points(3)); err != nil {
+		t.Errorf("%v: expected spooled write acknowledged, got err [%v]", fn, err)
+	}
+	b.Close()
+	if b.NumWrites() != 2 || b.NumSpooled() != 1 || len(tbl.written) != 2 {
+		t.Errorf("%v: expected 2 points written and 1 spooled, got [%v] written in [%v] rows and [%v] spooled",
+			fn, b.NumWrites(), len(tbl.written), b.NumSpooled())
+	}
+
+	var spooled []KeyValueEpochsec
+	spool, _ = OpenSpool(dir, 1<<20, 1<<20)
+	spool.Replay(func(points []KeyValueEpochsec) error {
+		spooled = append(spooled, points...)
+		return nil
+	})
+	if len(spooled) != 1 || spooled[0].Epochsec != 1001 {
+		t.Errorf("%v: expected the point at 1001 spooled, got [%v]", fn, spooled)
+	}
+}
+
+func TestBatcherCloseSpool(t *testing.T) {
+	const fn = "TestBatcherCloseSpool"
+
+	ctx := context.Background()
+	schema, _ := NewSchema("sec", KeyFormat{})
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("%v: cannot create dir, err [%v]", fn, err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := OpenSpool(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("%v: cannot open spool, err [%v]", fn, err)
+	}
+
+	config := BatcherConfig{NumWorkers: 1, MaxPoints: 100, MaxAge: 10 * time.Millisecond,
+		Spool: spool, ReplayInterval: time.Millisecond}
+	b := newBatcher(ctx, &outageApplier{down: true}, schema, nil, config)
+	b.Write(ctx, points(3))
+	b.Close()
+
+	// the replay is stopped and the spool closed, so that the points are
+	// left for the next process
+	if spool.w != nil {
+		t.Errorf("%v: expected the spool closed", fn)
+	}
+	spool, err = OpenSpool(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("%v: cannot open spool again, err [%v]", fn, err)
+	}
+	var replayed int
+	err = spool.Replay(func(points []KeyValueEpochsec) error {
+		replayed += len(points)
+		return nil
+	})
+	if err != nil || replayed != 3 {
+		t.Errorf("%v: expected 3 points replayed, got [%v], err [%v]", fn, replayed, err)
+	}
+}
+
+func TestWriteErrorStatus(t *testing.T) {
+	const fn = "TestWriteErrorStatus"
+
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{ErrSpooled, http.StatusServiceUnavailable},
+		{ErrDropped, http.StatusServiceUnavailable},
+		{errors.New("write failed"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		actual := WriteErrorStatus(test.err)
+		if actual != test.expected {
+			t.Errorf("%v: status of [%v] is [%v], expected [%v]", fn, test.err, actual, test.expected)
+		}
+	}
+}
+
+// blockingApplier blocks writes until release is closed, signalling started
+// as each write starts.
+type blockingApplier struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingApplier) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation,
+	opts ...bigtable.ApplyOption) ([]error, error) {
+
+	a.started <- struct{}{}
+	<-a.release
+	return nil, nil
+}
+
+func TestBatcherBackpressure(t *testing.T) {
+	const fn = "TestBatcherBackpressure"
+
+	ctx := context.Background()
+	schema, err := NewSchema("sec", KeyFormat{})
+	if err != nil {
+		t.Fatalf("%v: cannot create schema, err [%v]", fn, err)
+	}
+
+	tests := []struct {
+		policy BackpressurePolicy
+		// results are the results of the writes of the batches added
+		results []error
+	}{
+		{DropNewest, []error{nil, nil, ErrDropped}},
+		{DropOldest, []error{nil, ErrDropped, nil}},
+	}
+
+	for _, test := range tests {
+		tbl := &blockingApplier{started: make(chan struct{}, len(test.results)), release: make(chan struct{})}
+		config := BatcherConfig{NumWorkers: 1, MaxPoints: 1, MaxAge: time.Hour,
+			Backpressure: BackpressureConfig{Policy: test.policy}}
+		b := newBatcher(ctx, tbl, schema, nil, config)
+
+		results := make([]chan error, len(test.results))
+		for i := range results {
+			ch := make(chan error, 1)
+			results[i] = ch
+			b.Add(points(1), func(err error) { ch <- err })
+			if i == 0 {
+				// the worker takes the first batch and blocks in ApplyBulk
+				<-tbl.started
+			}
+		}
+
+		close(tbl.release)
+		for i, ch := range results {
+			if err := <-ch; err != test.results[i] {
+				t.Errorf("%v: [%v]: batch [%v] written with err [%v], expected [%v]", fn, test.policy, i, err, test.results[i])
+			}
+		}
+		if b.NumDropped() != 1 {
+			t.Errorf("%v: [%v]: expected 1 point dropped, got [%v]", fn, test.policy, b.NumDropped())
+		}
+		b.Close()
+	}
+}
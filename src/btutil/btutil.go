@@ -4,7 +4,6 @@ import (
 	"io/ioutil"
 	"log"
 
-	"crypto/md5"
 	"errors"
 	"fmt"
 
@@ -12,7 +11,6 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
-	"strconv"
 )
 
 func Clients(project, instance, authfile string) (*bigtable.Client, *bigtable.AdminClient) {
@@ -76,13 +74,13 @@ func CreateTableWithCF0IfMissing(adminClient *bigtable.AdminClient, table string
 }
 
 func GetBTKey(key string, epochSec uint32) string {
-	md5Sum := fmt.Sprintf("%x", md5.Sum([]byte(key)))
-
-	hour := int(epochSec / 3600)
-
-	sevenCharStr, _ := GetNCharStrLeadingZeros(strconv.Itoa(hour), 7)
+	return GetBucketKey(key, epochSec, 3600)
+}
 
-	return md5Sum + "_" + sevenCharStr
+// GetBucketKey returns the text row key of the bucket of width seconds holding
+// epochSec, the bucket number being zero padded to fit any epoch.
+func GetBucketKey(key string, epochSec, width uint32) string {
+	return KeyFormat{BucketWidth: width}.bucketRowKey(key, epochSec)
 }
 
 func GetNCharStrLeadingZeros(s string, n int) (string, error) {
@@ -0,0 +1,244 @@
+package btutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// GorillaEncoder compresses a series of points the way Facebook's Gorilla
+// does: timestamps are stored as delta of deltas and values as the XOR with the
+// previous value, both with variable length codes. Regular series with slowly
+// changing values take a bit or two per point.
+//
+// The encoded blob starts with the number of points as a big endian uint32,
+// followed by the first timestamp (32 bits) and value (64 bits) and the
+// compressed remaining points.
+type GorillaEncoder struct {
+	w     bitWriter
+	count uint32
+
+	prevEpochsec uint32
+	prevDelta    int64
+
+	prevValue                 uint64
+	prevLeading, prevTrailing int
+}
+
+// Append adds a point to the blob. Timestamps should be appended in ascending order.
+func (g *GorillaEncoder) Append(tv TimeValue) {
+	value := math.Float64bits(tv.Value)
+
+	if g.count == 0 {
+		g.w.writeBits(uint64(tv.Epochsec), 32)
+		g.w.writeBits(value, 64)
+
+		g.prevEpochsec = tv.Epochsec
+		g.prevValue = value
+		g.prevLeading = -1
+		g.count++
+		return
+	}
+
+	delta := int64(tv.Epochsec) - int64(g.prevEpochsec)
+	g.writeDeltaOfDelta(delta - g.prevDelta)
+	g.writeValue(value)
+
+	g.prevEpochsec = tv.Epochsec
+	g.prevDelta = delta
+	g.count++
+}
+
+// Bytes returns the encoded blob.
+func (g *GorillaEncoder) Bytes() []byte {
+	b := make([]byte, 4, 4+len(g.w.buf))
+	binary.BigEndian.PutUint32(b, g.count)
+
+	return append(b, g.w.buf...)
+}
+
+func (g *GorillaEncoder) writeDeltaOfDelta(dod int64) {
+	switch {
+	case dod == 0:
+		g.w.writeBits(0, 1)
+	case -63 <= dod && dod <= 64:
+		g.w.writeBits(0x2, 2)
+		g.w.writeBits(uint64(dod), 7)
+	case -255 <= dod && dod <= 256:
+		g.w.writeBits(0x6, 3)
+		g.w.writeBits(uint64(dod), 9)
+	case -2047 <= dod && dod <= 2048:
+		g.w.writeBits(0xe, 4)
+		g.w.writeBits(uint64(dod), 12)
+	default:
+		g.w.writeBits(0xf, 4)
+		g.w.writeBits(uint64(dod), 64)
+	}
+}
+
+func (g *GorillaEncoder) writeValue(value uint64) {
+	xor := value ^ g.prevValue
+	g.prevValue = value
+
+	if xor == 0 {
+		g.w.writeBits(0, 1)
+		return
+	}
+
+	leading := bits.LeadingZeros64(xor)
+	trailing := bits.TrailingZeros64(xor)
+	if leading > 31 {
+		// the leading zero count is stored in 5 bits
+		leading = 31
+	}
+
+	if g.prevLeading != -1 && leading >= g.prevLeading && trailing >= g.prevTrailing {
+		// the meaningful bits fit in the previous window
+		g.w.writeBits(0x2, 2)
+		g.w.writeBits(xor>>uint(g.prevTrailing), 64-g.prevLeading-g.prevTrailing)
+		return
+	}
+
+	meaningful := 64 - leading - trailing
+	g.w.writeBits(0x3, 2)
+	g.w.writeBits(uint64(leading), 5)
+	// 64 meaningful bits do not fit in 6 bits and are stored as 0
+	g.w.writeBits(uint64(meaningful&0x3f), 6)
+	g.w.writeBits(xor>>uint(trailing), meaningful)
+
+	g.prevLeading = leading
+	g.prevTrailing = trailing
+}
+
+// EncodeGorilla compresses points into a blob. See GorillaEncoder.
+func EncodeGorilla(points []TimeValue) []byte {
+	var g GorillaEncoder
+	for _, e := range points {
+		g.Append(e)
+	}
+
+	return g.Bytes()
+}
+
+// DecodeGorilla decompresses a blob written by GorillaEncoder.
+func DecodeGorilla(b []byte) ([]TimeValue, error) {
+	if len(b) < 4 {
+		return nil, errors.New(fmt.Sprintf("invalid gorilla blob of [%v] bytes", len(b)))
+	}
+
+	count := binary.BigEndian.Uint32(b)
+	if count == 0 {
+		return nil, nil
+	}
+	// the first point takes 96 bits and every other point at least 2, so
+	// that a corrupt count cannot make us allocate more than the blob holds
+	if 96+2*uint64(count-1) > 8*uint64(len(b)-4) {
+		return nil, errors.New(fmt.Sprintf("invalid gorilla blob. [%v] bytes cannot hold [%v] points", len(b), count))
+	}
+
+	r := bitReader{buf: b[4:]}
+	epochsec := uint32(r.readBits(32))
+	value := r.readBits(64)
+	if r.err != nil {
+		return nil, errors.New(fmt.Sprintf("truncated gorilla blob. read [0] of [%v] points", count))
+	}
+
+	points := make([]TimeValue, 0, count)
+	points = append(points, TimeValue{epochsec, math.Float64frombits(value)})
+
+	var delta int64
+	leading, trailing := 0, 0
+	for i := uint32(1); i < count; i++ {
+		delta += readDeltaOfDelta(&r)
+		epochsec = uint32(int64(epochsec) + delta)
+
+		if r.readBits(1) == 1 {
+			if r.readBits(1) == 1 {
+				leading = int(r.readBits(5))
+				meaningful := int(r.readBits(6))
+				if meaningful == 0 {
+					meaningful = 64
+				}
+				trailing = 64 - leading - meaningful
+			}
+			value ^= r.readBits(64-leading-trailing) << uint(trailing)
+		}
+
+		if r.err != nil {
+			return nil, errors.New(fmt.Sprintf("truncated gorilla blob. read [%v] of [%v] points", i, count))
+		}
+		points = append(points, TimeValue{epochsec, math.Float64frombits(value)})
+	}
+
+	return points, nil
+}
+
+func readDeltaOfDelta(r *bitReader) int64 {
+	var n int
+	switch {
+	case r.readBits(1) == 0:
+		return 0
+	case r.readBits(1) == 0:
+		n = 7
+	case r.readBits(1) == 0:
+		n = 9
+	case r.readBits(1) == 0:
+		n = 12
+	default:
+		n = 64
+	}
+
+	dod := int64(r.readBits(n))
+	if n < 64 && dod > int64(1)<<uint(n-1) {
+		// sign extend
+		dod -= int64(1) << uint(n)
+	}
+
+	return dod
+}
+
+// bitWriter appends bits most significant first.
+type bitWriter struct {
+	buf   []byte
+	nbits uint
+}
+
+// writeBits writes the n low bits of v.
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v&(1<<uint(i)) != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.nbits % 8)
+		}
+		w.nbits++
+	}
+}
+
+// bitReader reads bits written by bitWriter. Reading past the end sets err and returns zeros.
+type bitReader struct {
+	buf   []byte
+	nbits uint
+	err   error
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		if r.nbits/8 >= uint(len(r.buf)) {
+			r.err = errors.New("end of blob")
+			return 0
+		}
+
+		v <<= 1
+		if r.buf[r.nbits/8]&(0x80>>(r.nbits%8)) != 0 {
+			v |= 1
+		}
+		r.nbits++
+	}
+
+	return v
+}
@@ -0,0 +1,100 @@
+package btutil
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGorillaRoundTrip(t *testing.T) {
+	const fn = "TestGorillaRoundTrip"
+
+	var regular []TimeValue
+	for i := 0; i < 3600; i++ {
+		regular = append(regular, TimeValue{1500000000 + uint32(i), 42})
+	}
+
+	tests := []struct {
+		name   string
+		points []TimeValue
+	}{
+		{"empty", nil},
+		{"single", []TimeValue{{1500000000, 1.5}}},
+		{"regular", regular},
+		{"irregular", []TimeValue{{100, 1}, {101, 2}, {161, -2.25}, {500, 1e300}, {4000, 0}, {4000, 0}, {90000, 3}}},
+		{"special", []TimeValue{{1, math.Inf(1)}, {2, math.Inf(-1)}, {3, math.MaxFloat64}, {4, math.SmallestNonzeroFloat64}, {5, -0.0}}},
+	}
+
+	for _, e := range tests {
+		output, err := DecodeGorilla(EncodeGorilla(e.points))
+		if err != nil {
+			t.Errorf("%v: %v: cannot decode, err [%v]", fn, e.name, err)
+			continue
+		}
+		if len(output) != len(e.points) {
+			t.Errorf("%v: %v: expected [%v] points, got [%v]", fn, e.name, len(e.points), len(output))
+			continue
+		}
+		for i := range output {
+			if output[i].Epochsec != e.points[i].Epochsec ||
+				math.Float64bits(output[i].Value) != math.Float64bits(e.points[i].Value) {
+				t.Errorf("%v: %v: expected [%v] at [%v], got [%v]", fn, e.name, e.points[i], i, output[i])
+			}
+		}
+	}
+}
+
+func TestGorillaSize(t *testing.T) {
+	const fn = "TestGorillaSize"
+
+	var points []TimeValue
+	for i := 0; i < 3600; i++ {
+		points = append(points, TimeValue{1500000000 + uint32(i*10), float64(i / 60)})
+	}
+
+	raw := len(points) * secofhourValueSize
+	compressed := len(EncodeGorilla(points))
+	if compressed*10 > raw {
+		t.Errorf("%v: expected at least 10x compression of [%v] bytes, got [%v] bytes", fn, raw, compressed)
+	}
+}
+
+func TestDecodeGorillaTruncated(t *testing.T) {
+	const fn = "TestDecodeGorillaTruncated"
+
+	b := EncodeGorilla([]TimeValue{{100, 1}, {110, 2}, {125, 3.5}})
+	_, err := DecodeGorilla(b[:len(b)-2])
+	if err == nil {
+		t.Errorf("%v: expected error for truncated blob", fn)
+	}
+}
+
+func TestDecodeGorillaCorrupt(t *testing.T) {
+	const fn = "TestDecodeGorillaCorrupt"
+
+	single := EncodeGorilla([]TimeValue{{100, 1}})
+	three := EncodeGorilla([]TimeValue{{100, 1}, {110, 2}, {125, 3.5}})
+	withCount := func(b []byte, count byte) []byte {
+		result := append([]byte(nil), b...)
+		result[3] = count
+		return result
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"no count", []byte{0, 0}},
+		{"count only", []byte{0, 0, 0, 1}},
+		{"truncated first point", single[:len(single)-1]},
+		{"truncated first timestamp", three[:6]},
+		{"huge count", []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+		{"count past the points", withCount(three, 200)},
+	}
+
+	for _, test := range tests {
+		points, err := DecodeGorilla(test.input)
+		if err == nil {
+			t.Errorf("%v: %v: expected error, got points [%v]", fn, test.name, points)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package btutil
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/cespare/xxhash"
+	"github.com/spaolacci/murmur3"
+)
+
+// hashFuncs are the functions hashing the key of a series into the prefix of
+// its row keys, by name.
+var hashFuncs = map[string]func([]byte) []byte{
+	"md5": func(b []byte) []byte {
+		sum := md5.Sum(b)
+		return sum[:]
+	},
+	"fnv1a": func(b []byte) []byte {
+		h := fnv.New64a()
+		h.Write(b)
+		return h.Sum(nil)
+	},
+	"xxhash": func(b []byte) []byte {
+		sum := make([]byte, 8)
+		binary.BigEndian.PutUint64(sum, xxhash.Sum64(b))
+		return sum
+	},
+	"murmur3": func(b []byte) []byte {
+		h1, h2 := murmur3.Sum128(b)
+		sum := make([]byte, 16)
+		binary.BigEndian.PutUint64(sum, h1)
+		binary.BigEndian.PutUint64(sum[8:], h2)
+		return sum
+	},
+}
+
+// hashSizes are the sizes in bytes of the hash functions.
+var hashSizes = map[string]int{
+	"md5":     md5.Size,
+	"fnv1a":   8,
+	"xxhash":  8,
+	"murmur3": 16,
+}
+
+// hashName returns the name of the hash function of the key format.
+func (f KeyFormat) hashName() string {
+	if f.Hash == "" {
+		return "md5"
+	}
+	return f.Hash
+}
+
+// hashLen returns the length in bytes of the, possibly truncated, hash in row keys.
+func (f KeyFormat) hashLen() int {
+	if f.HashLen == 0 {
+		return hashSizes[f.hashName()]
+	}
+	return f.HashLen
+}
+
+// seriesHash returns the hash of the key of a series, truncated to hashLen.
+func (f KeyFormat) seriesHash(key string) []byte {
+	return hashFuncs[f.hashName()]([]byte(key))[:f.hashLen()]
+}
@@ -0,0 +1,83 @@
+package btutil
+
+import (
+	"testing"
+)
+
+func TestKeyFormatHash(t *testing.T) {
+	const fn = "TestKeyFormatHash"
+
+	tests := []struct {
+		format      KeyFormat
+		expectedLen int
+	}{
+		{KeyFormat{}, 16},
+		{KeyFormat{Hash: "md5", HashLen: 6}, 6},
+		{KeyFormat{Hash: "fnv1a"}, 8},
+		{KeyFormat{Hash: "xxhash"}, 8},
+		{KeyFormat{Hash: "xxhash", HashLen: 4}, 4},
+		{KeyFormat{Hash: "murmur3"}, 16},
+	}
+
+	for _, e := range tests {
+		if err := e.format.validate(); err != nil {
+			t.Errorf("%v: %+v: unexpected err [%v]", fn, e.format, err)
+			continue
+		}
+
+		textKey := e.format.rowKey("key_1", 1500000000, epochsecDigits)
+		if len(textKey) != 2*e.expectedLen+1+epochsecDigits {
+			t.Errorf("%v: %+v: unexpected text row key [%v]", fn, e.format, textKey)
+		}
+
+		binaryFormat := e.format
+		binaryFormat.Binary = true
+		binaryKey := binaryFormat.rowKey("key_1", 1500000000, epochsecDigits)
+		if len(binaryKey) != e.expectedLen+binaryBucketSize {
+			t.Errorf("%v: %+v: expected [%v] bytes, got [%q]", fn, e.format, e.expectedLen+binaryBucketSize, binaryKey)
+		}
+
+		for _, f := range []KeyFormat{e.format, binaryFormat} {
+			rowKey := f.rowKey("key_1", 1500000000, epochsecDigits)
+			bucket, err := f.bucket(rowKey, epochsecDigits)
+			if err != nil || bucket != 1500000000 {
+				t.Errorf("%v: %+v: expected bucket [1500000000], got [%v], err [%v]", fn, f, bucket, err)
+			}
+			if f.rowKey("key_2", 1500000000, epochsecDigits) == rowKey {
+				t.Errorf("%v: %+v: expected different row keys for different keys", fn, f)
+			}
+		}
+	}
+
+	invalid := []KeyFormat{{Hash: "sha1"}, {HashLen: 17}, {Hash: "fnv1a", HashLen: 9}, {HashLen: -1}}
+	for _, e := range invalid {
+		if _, err := NewSchema("sec", e); err == nil {
+			t.Errorf("%v: %+v: expected error", fn, e)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	const fn = "TestCheckName"
+
+	points := []TimeValue{{7200, 1.5}}
+	ktv := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: points}
+	format := KeyFormat{StoreNames: true}
+
+	for _, layout := range []string{"sec", "hourcol", "hourblob", "hourgorilla"} {
+		schema, _ := NewSchema(layout, format)
+
+		// the mutations store the name of the series next to its points
+		row := writeRow(t, schema, ktv)
+
+		output, err := schema.Points(Series{Name: "key_1"}, row)
+		if err != nil || len(output) != 1 || output[0] != points[0] {
+			t.Errorf("%v: %v: expected [%v], got [%v], err [%v]", fn, layout, points, output, err)
+		}
+
+		_, err = schema.Points(Series{Name: "colliding_key"}, row)
+		if err == nil {
+			t.Errorf("%v: %v: expected collision error", fn, layout)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package btutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// hourBlobSchema stores one row per bucket, an hour by default, keyed like
+// GetBTKey. Each write packs all its points into a single blob stored under the
+// md5 of the blob. Blobs are either SecofhourValue slices, whose SecOfHour is
+// the second of the bucket, or, when gorilla is set, Gorilla compressed.
+//
+// Blobs are written with the time of the write as cell timestamp. When blobs
+// hold points at the same second, the one of the newest blob wins, and of
+// blobs with the same timestamp the one of the last blob in qualifier order.
+type hourBlobSchema struct {
+	format  KeyFormat
+	gorilla bool
+}
+
+type SecofhourValue struct {
+	SecOfHour uint16
+	Value     float64
+}
+
+// secofhourValueSize is the encoded size of a SecofhourValue.
+const secofhourValueSize = 10
+
+func (s hourBlobSchema) Name() string {
+	if s.gorilla {
+		return "hourgorilla"
+	}
+	return "hourblob"
+}
+
+func (s hourBlobSchema) Format() KeyFormat {
+	return s.format
+}
+
+func (s hourBlobSchema) Mutations(ktv KeyTimevalues) ([]string, []*bigtable.Mutation) {
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	key := ktv.Series.String()
+	for _, e := range SplitByBucket(ktv, s.format.width()) {
+		bytes := s.blob(e.Timevalues)
+
+		mut := bigtable.NewMutation()
+		mut.Set(column_family, md5Str(bytes), blobTimestamp(), bytes)
+		s.format.setName(mut, key)
+
+		muts = append(muts, mut)
+		rowKeys = append(rowKeys, s.format.bucketRowKey(key, e.Timevalues[0].Epochsec))
+	}
+
+	return rowKeys, muts
+}
+
+func (s hourBlobSchema) RowKey(series Series, epochsec uint32) string {
+	return s.format.bucketRowKey(series.String(), epochsec)
+}
+
+// blob encodes points falling in the same bucket.
+func (s hourBlobSchema) blob(points []TimeValue) []byte {
+	if s.gorilla {
+		return EncodeGorilla(points)
+	}
+
+	var secofhourValues []SecofhourValue
+	for _, e := range points {
+		secofhourValues = append(secofhourValues, SecofhourValue{uint16(e.Epochsec % s.format.width()), e.Value})
+	}
+	return toBigEndianBytes(secofhourValues)
+}
+
+func (s hourBlobSchema) Points(series Series, row bigtable.Row) ([]TimeValue, error) {
+	start, err := s.format.bucketStart(row.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkName(series.String(), row)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode the blobs oldest first, so that points of newer blobs win
+	items := append([]bigtable.ReadItem(nil), row[column_family]...)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Timestamp < items[j].Timestamp
+	})
+
+	var points []TimeValue
+	for _, e := range items {
+		if isName(e) {
+			continue
+		}
+
+		if s.gorilla {
+			decoded, err := DecodeGorilla(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, decoded...)
+			continue
+		}
+
+		secofhourValues, err := fromBigEndianBytes(e.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e2 := range secofhourValues {
+			points = append(points, TimeValue{start + uint32(e2.SecOfHour), e2.Value})
+		}
+	}
+
+	return MergePoints(points), nil
+}
+
+// lastBlobTimestamp is the cell timestamp of the last blob written, in micros.
+var lastBlobTimestamp int64
+
+// blobTimestamp returns the cell timestamp of a blob written now. Timestamps
+// have the millisecond granularity of bigtable and increase with every blob
+// written by the process, so that a blob written after another is newer.
+func blobTimestamp() bigtable.Timestamp {
+	for {
+		last := atomic.LoadInt64(&lastBlobTimestamp)
+		ts := int64(bigtable.Now().TruncateToMilliseconds())
+		if ts <= last {
+			ts = last + 1000
+		}
+		if atomic.CompareAndSwapInt64(&lastBlobTimestamp, last, ts) {
+			return bigtable.Timestamp(ts)
+		}
+	}
+}
+
+func (s hourBlobSchema) RowRanges(series Series, from, until uint32) []bigtable.RowRange {
+	return s.format.bucketRowRanges(series.String(), from, until)
+}
+
+func toBigEndianBytes(slice []SecofhourValue) []byte {
+	var buffer bytes.Buffer
+	err := binary.Write(&buffer, binary.BigEndian, slice)
+	if err != nil {
+		log.Fatalf("cannot convert slice %+v to byte array, err [%v]", slice, err)
+	}
+
+	return buffer.Bytes()
+}
+
+func fromBigEndianBytes(b []byte) ([]SecofhourValue, error) {
+	if len(b)%secofhourValueSize != 0 {
+		return nil, errors.New(fmt.Sprintf("invalid blob of [%v] bytes. should be a multiple of %v", len(b), secofhourValueSize))
+	}
+
+	slice := make([]SecofhourValue, len(b)/secofhourValueSize)
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, slice)
+	if err != nil {
+		return nil, err
+	}
+
+	return slice, nil
+}
+
+func md5Str(input []byte) string {
+	md5bytes := md5.Sum(input)
+
+	return string(md5bytes[:])
+}
@@ -0,0 +1,87 @@
+package btutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// hourColSchema stores one row per bucket, an hour by default, keyed like
+// GetBTKey, with one column per point whose qualifier is the second of the bucket.
+type hourColSchema struct {
+	format KeyFormat
+}
+
+func (hourColSchema) Name() string {
+	return "hourcol"
+}
+
+func (s hourColSchema) Format() KeyFormat {
+	return s.format
+}
+
+func (s hourColSchema) Mutations(ktv KeyTimevalues) ([]string, []*bigtable.Mutation) {
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	width := s.format.width()
+	key := ktv.Series.String()
+	for _, e := range SplitByBucket(ktv, width) {
+		mut := bigtable.NewMutation()
+		for _, e2 := range e.Timevalues {
+			kves := KeyValueEpochsec{Series: e.Series, Value: e2.Value, Epochsec: e2.Epochsec}
+			secOfBucket := int(e2.Epochsec % width)
+			mut.Set(column_family, strconv.Itoa(secOfBucket), 0, kves.ValueByteArray())
+		}
+		s.format.setName(mut, key)
+
+		muts = append(muts, mut)
+		rowKeys = append(rowKeys, s.format.bucketRowKey(key, e.Timevalues[0].Epochsec))
+	}
+
+	return rowKeys, muts
+}
+
+func (s hourColSchema) RowKey(series Series, epochsec uint32) string {
+	return s.format.bucketRowKey(series.String(), epochsec)
+}
+
+func (s hourColSchema) Points(series Series, row bigtable.Row) ([]TimeValue, error) {
+	start, err := s.format.bucketStart(row.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkName(series.String(), row)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []TimeValue
+	for _, e := range row[column_family] {
+		if isName(e) {
+			continue
+		}
+
+		secOfBucket, err := strconv.Atoi(qualifier(e))
+		if err != nil {
+			return nil, err
+		}
+
+		var value float64
+		err = binary.Read(bytes.NewReader(e.Value), binary.BigEndian, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, TimeValue{start + uint32(secOfBucket), value})
+	}
+
+	// qualifiers are ordered as strings, so "10" comes before "9"
+	return MergePoints(points), nil
+}
+
+func (s hourColSchema) RowRanges(series Series, from, until uint32) []bigtable.RowRange {
+	return s.format.bucketRowRanges(series.String(), from, until)
+}
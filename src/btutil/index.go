@@ -0,0 +1,219 @@
+package btutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// Columns of the rows of the series index table, in column family 0.
+const (
+	index_name_qualifier  = "name"
+	index_first_qualifier = "first"
+	index_last_qualifier  = "last"
+)
+
+// indexLastSeenResolution is how far in seconds the points of a series must
+// move past the last seen time in the index before it is rewritten.
+const indexLastSeenResolution = 60
+
+// SeriesInfo is the entry of a series in the series index.
+type SeriesInfo struct {
+	Series    Series
+	FirstSeen uint32
+	LastSeen  uint32
+}
+
+// SeriesIndex maintains the index table mapping the hash of every series in
+// the row keys of a data table back to the series, with the time range it was
+// seen in. Row keys of the index are the hashes as they appear in data row
+// keys, see KeyFormat.HashKey. The table is created like data tables by createtable.
+type SeriesIndex struct {
+	tbl    *bigtable.Table
+	format KeyFormat
+
+	lock sync.Mutex
+	// lastSeen is the last seen time written to the index, by series
+	lastSeen map[string]uint32
+}
+
+// NewSeriesIndex returns the index stored in tbl of the series written with format.
+func NewSeriesIndex(tbl *bigtable.Table, format KeyFormat) *SeriesIndex {
+	return &SeriesIndex{tbl: tbl, format: format, lastSeen: make(map[string]uint32)}
+}
+
+// Update records that the series of slice were written. It writes a series
+// the first time it is seen by this process and then only when its last seen
+// time moved. The first seen time is never overwritten. Update on a nil index
+// does nothing, so that writers can run without an index.
+func (x *SeriesIndex) Update(ctx context.Context, slice []KeyTimevalues) error {
+	if x == nil {
+		return nil
+	}
+
+	type update struct {
+		series      Series
+		first, last uint32
+		isNew       bool
+	}
+
+	var updates []update
+	x.lock.Lock()
+	for _, e := range slice {
+		if len(e.Timevalues) == 0 {
+			continue
+		}
+
+		first, last := e.Timevalues[0].Epochsec, e.Timevalues[0].Epochsec
+		for _, e2 := range e.Timevalues {
+			if e2.Epochsec < first {
+				first = e2.Epochsec
+			}
+			if e2.Epochsec > last {
+				last = e2.Epochsec
+			}
+		}
+
+		lastSeen, found := x.lastSeen[e.Series.String()]
+		if !found || last >= lastSeen+indexLastSeenResolution {
+			updates = append(updates, update{e.Series, first, last, !found})
+		}
+	}
+	x.lock.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	for _, e := range updates {
+		rowKey := x.format.HashKey(e.series)
+
+		if e.isNew {
+			// sets the first seen time unless the row already has one
+			first := bigtable.NewMutation()
+			first.Set(column_family, index_first_qualifier, 0, uint32Bytes(e.first))
+			cond := bigtable.NewCondMutation(bigtable.ColumnFilter(index_first_qualifier), nil, first)
+
+			err := x.tbl.Apply(ctx, rowKey, cond)
+			if err != nil {
+				return err
+			}
+		}
+
+		mut := bigtable.NewMutation()
+		mut.Set(column_family, index_name_qualifier, 0, []byte(e.series.String()))
+		mut.Set(column_family, index_last_qualifier, 0, uint32Bytes(e.last))
+
+		rowKeys = append(rowKeys, rowKey)
+		muts = append(muts, mut)
+	}
+
+	errs, err := x.tbl.ApplyBulk(ctx, rowKeys, muts)
+	if err != nil {
+		return err
+	}
+	for i, e := range errs {
+		if e != nil {
+			return errors.New(fmt.Sprintf("cannot update index row [%q], err [%v]", rowKeys[i], e))
+		}
+	}
+
+	x.lock.Lock()
+	for _, e := range updates {
+		key := e.series.String()
+		if e.last > x.lastSeen[key] {
+			x.lastSeen[key] = e.last
+		}
+	}
+	x.lock.Unlock()
+
+	return nil
+}
+
+// Resolve returns the series whose hash in row keys is hash, see KeyFormat.RowKeyHash.
+// The returned bool is false if the index has no such series.
+func (x *SeriesIndex) Resolve(ctx context.Context, hash string) (SeriesInfo, bool, error) {
+	row, err := x.tbl.ReadRow(ctx, hash, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return SeriesInfo{}, false, err
+	}
+	if len(row) == 0 {
+		return SeriesInfo{}, false, nil
+	}
+
+	info, err := seriesInfo(row)
+	if err != nil {
+		return SeriesInfo{}, false, err
+	}
+
+	return info, true, nil
+}
+
+// List calls f with every series of the index, in the order of their hashes,
+// until f returns false.
+func (x *SeriesIndex) List(ctx context.Context, f func(SeriesInfo) bool) error {
+	var err error
+	readErr := x.tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		var info SeriesInfo
+		info, err = seriesInfo(row)
+		if err != nil {
+			return false
+		}
+
+		return f(info)
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if readErr != nil {
+		return readErr
+	}
+
+	return err
+}
+
+// seriesInfo decodes a row of the index.
+func seriesInfo(row bigtable.Row) (SeriesInfo, error) {
+	var info SeriesInfo
+	var hasName bool
+	for _, e := range row[column_family] {
+		switch qualifier(e) {
+		case index_name_qualifier:
+			series, err := ParseSeries(string(e.Value))
+			if err != nil {
+				return SeriesInfo{}, err
+			}
+			info.Series = series
+			hasName = true
+		case index_first_qualifier, index_last_qualifier:
+			if len(e.Value) != 4 {
+				err := errors.New(fmt.Sprintf("invalid time of [%v] bytes in index row [%q]", len(e.Value), row.Key()))
+				log.Printf("err [%v]", err)
+				return SeriesInfo{}, err
+			}
+			if qualifier(e) == index_first_qualifier {
+				info.FirstSeen = binary.BigEndian.Uint32(e.Value)
+			} else {
+				info.LastSeen = binary.BigEndian.Uint32(e.Value)
+			}
+		}
+	}
+
+	if !hasName {
+		err := errors.New(fmt.Sprintf("index row [%q] has no series name", row.Key()))
+		log.Printf("err [%v]", err)
+		return SeriesInfo{}, err
+	}
+
+	return info, nil
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
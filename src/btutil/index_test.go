@@ -0,0 +1,102 @@
+package btutil
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// emulatorTable creates table with column family 0 in an in-process bigtable emulator.
+func emulatorTable(t *testing.T, table string) *bigtable.Table {
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("cannot start bigtable emulator, err [%v]", err)
+	}
+	t.Cleanup(srv.Close)
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("cannot connect to bigtable emulator, err [%v]", err)
+	}
+
+	ctx := context.Background()
+	adminClient, err := bigtable.NewAdminClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("cannot create admin client, err [%v]", err)
+	}
+	CreateTableWithCF0IfMissing(adminClient, table)
+
+	client, err := bigtable.NewClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("cannot create client, err [%v]", err)
+	}
+
+	return client.Open(table)
+}
+
+func TestSeriesIndex(t *testing.T) {
+	const fn = "TestSeriesIndex"
+
+	ctx := context.Background()
+	format := KeyFormat{Binary: true, SaltBuckets: 4}
+	index := NewSeriesIndex(emulatorTable(t, "index"), format)
+
+	cpu := NewSeries("cpu", map[string]string{"host": "a"})
+	mem := Series{Name: "mem"}
+
+	err := index.Update(ctx, []KeyTimevalues{
+		{cpu, []TimeValue{{1000, 1}, {1010, 2}}},
+		{mem, []TimeValue{{1005, 3}}},
+	})
+	if err != nil {
+		t.Fatalf("%v: cannot update index, err [%v]", fn, err)
+	}
+
+	// last seen only moves once it is a minute later, first seen never moves
+	for _, e := range []uint32{1020, 900, 1100} {
+		err = index.Update(ctx, []KeyTimevalues{{cpu, []TimeValue{{e, 1}}}})
+		if err != nil {
+			t.Fatalf("%v: cannot update index, err [%v]", fn, err)
+		}
+	}
+
+	// a new process sees the series for the first time again
+	err = NewSeriesIndex(index.tbl, format).Update(ctx, []KeyTimevalues{{cpu, []TimeValue{{1200, 1}}}})
+	if err != nil {
+		t.Fatalf("%v: cannot update index, err [%v]", fn, err)
+	}
+
+	schema, _ := NewSchema("sec", format)
+	rowKeys, _ := schema.Mutations(KeyTimevalues{cpu, []TimeValue{{1000, 1}}})
+	hash, err := format.RowKeyHash(rowKeys[0])
+	if err != nil || hash != format.HashKey(cpu) {
+		t.Errorf("%v: expected hash [%q] of row key [%q], got [%q], err [%v]", fn, format.HashKey(cpu), rowKeys[0], hash, err)
+	}
+
+	info, found, err := index.Resolve(ctx, hash)
+	expected := SeriesInfo{cpu, 1000, 1200}
+	if err != nil || !found || !reflect.DeepEqual(info, expected) {
+		t.Errorf("%v: expected [%+v], got [%+v], found [%v], err [%v]", fn, expected, info, found, err)
+	}
+
+	_, found, err = index.Resolve(ctx, format.HashKey(Series{Name: "missing"}))
+	if err != nil || found {
+		t.Errorf("%v: expected missing series, got found [%v], err [%v]", fn, found, err)
+	}
+
+	listed := make(map[string]SeriesInfo)
+	err = index.List(ctx, func(info SeriesInfo) bool {
+		listed[info.Series.String()] = info
+		return true
+	})
+	expectedList := map[string]SeriesInfo{cpu.String(): {cpu, 1000, 1200}, mem.String(): {mem, 1005, 1005}}
+	if err != nil || !reflect.DeepEqual(listed, expectedList) {
+		t.Errorf("%v: expected [%+v], got [%+v], err [%v]", fn, expectedList, listed, err)
+	}
+}
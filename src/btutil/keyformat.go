@@ -0,0 +1,247 @@
+package btutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"strconv"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// KeyFormat describes how row keys are built from the key of a series and a
+// time bucket. The zero value builds the text keys of BTRowKeyStr and GetBTKey:
+// the hex md5 of the key, an underscore and the zero padded bucket.
+type KeyFormat struct {
+	// Binary builds keys from the raw hash of the key followed by the bucket as
+	// a big endian uint32, 20 bytes instead of 40 or more with md5.
+	Binary bool
+
+	// Hash names the hash of the key leading the row keys: md5, fnv1a, xxhash
+	// or murmur3. Empty means md5.
+	Hash string
+
+	// HashLen truncates the hash to its first HashLen bytes, trading key size
+	// for collision risk. Zero keeps the whole hash.
+	HashLen int
+
+	// StoreNames stores the key of the series in every row written, so that
+	// reads detect rows of other series colliding on the hash.
+	StoreNames bool
+
+	// SaltBuckets prefixes row keys with a salt in [0, SaltBuckets) derived
+	// from the series and the time bucket, so that consecutive rows of a heavy
+	// series land on different tablets. Readers then scan every salt. Zero
+	// disables salting.
+	SaltBuckets int
+
+	// BucketWidth is the width in seconds of the rows of the bucketed layouts.
+	// Zero means an hour. The sec layout always has one second rows.
+	BucketWidth uint32
+}
+
+// width returns the bucket width of the bucketed layouts.
+func (f KeyFormat) width() uint32 {
+	if f.BucketWidth == 0 {
+		return 3600
+	}
+	return f.BucketWidth
+}
+
+// bucketDigits returns the number of digits needed to zero pad any bucket of the given width.
+func bucketDigits(width uint32) int {
+	return len(strconv.FormatUint(uint64(math.MaxUint32/width), 10))
+}
+
+// bucketRowKey returns the row key of the bucket holding epochsec in the bucketed layouts.
+func (f KeyFormat) bucketRowKey(key string, epochsec uint32) string {
+	width := f.width()
+	return f.rowKey(key, epochsec/width, bucketDigits(width))
+}
+
+// bucketStart parses the row key of a bucketed layout and returns the epochsec the bucket starts at.
+func (f KeyFormat) bucketStart(rowKey string) (uint32, error) {
+	width := f.width()
+	bucket, err := f.bucket(rowKey, bucketDigits(width))
+	if err != nil {
+		return 0, err
+	}
+
+	return bucket * width, nil
+}
+
+// bucketRowRanges returns the ranges of rows of the bucketed layouts covering [from, until).
+func (f KeyFormat) bucketRowRanges(key string, from, until uint32) []bigtable.RowRange {
+	width := f.width()
+
+	end := until / width
+	if until%width != 0 {
+		end++
+	}
+	return f.rowRanges(key, from/width, end, bucketDigits(width))
+}
+
+// binaryBucketSize is the size of the bucket at the end of binary row keys.
+const binaryBucketSize = 4
+
+// maxSaltBuckets is the number of salts fitting the one byte salt of binary row keys.
+const maxSaltBuckets = 256
+
+// rowKey returns the row key of the bucket of key. Text keys pad the bucket to digits.
+func (f KeyFormat) rowKey(key string, bucket uint32, digits int) string {
+	hash := f.seriesHash(key)
+	return f.saltedRowKey(f.salt(hash, bucket), hash, bucket, digits)
+}
+
+// salt returns the salt of the bucket of a series, rotating over the salt
+// buckets from one time bucket to the next. It is -1 without salting.
+func (f KeyFormat) salt(hash []byte, bucket uint32) int {
+	if f.SaltBuckets == 0 {
+		return -1
+	}
+
+	h := fnv.New32a()
+	h.Write(hash)
+	return int((uint64(h.Sum32()) + uint64(bucket)) % uint64(f.SaltBuckets))
+}
+
+// saltedRowKey builds a row key from its parts. A salt of -1 is left out.
+func (f KeyFormat) saltedRowKey(salt int, hash []byte, bucket uint32, digits int) string {
+	if f.Binary {
+		var b []byte
+		if salt != -1 {
+			b = append(b, byte(salt))
+		}
+		b = append(b, hash...)
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-binaryBucketSize:], bucket)
+		return string(b)
+	}
+
+	var saltStr string
+	if salt != -1 {
+		saltStr = fmt.Sprintf("%02x", salt)
+	}
+	bucketStr, _ := GetNCharStrLeadingZeros(strconv.FormatUint(uint64(bucket), 10), digits)
+	return saltStr + fmt.Sprintf("%x", hash) + "_" + bucketStr
+}
+
+// bucket parses the bucket of a row key built by rowKey.
+func (f KeyFormat) bucket(rowKey string, digits int) (uint32, error) {
+	if f.Binary {
+		size := f.hashLen() + binaryBucketSize
+		if f.SaltBuckets != 0 {
+			size++
+		}
+		if len(rowKey) != size {
+			return 0, errors.New(fmt.Sprintf("invalid binary row key [%x]. should have %v bytes", rowKey, size))
+		}
+		return RowKey(rowKey).BinaryBucket()
+	}
+
+	return RowKey(rowKey).timeToken(digits)
+}
+
+// HashKey returns the hash of series as it appears in row keys: hex in text
+// keys, raw in binary keys, without salt.
+func (f KeyFormat) HashKey(series Series) string {
+	hash := f.seriesHash(series.String())
+	if f.Binary {
+		return string(hash)
+	}
+
+	return fmt.Sprintf("%x", hash)
+}
+
+// RowKeyHash returns the hash of the series of a row key, as returned by HashKey.
+func (f KeyFormat) RowKeyHash(rowKey string) (string, error) {
+	var salt int
+	if f.SaltBuckets != 0 {
+		salt = 2
+		if f.Binary {
+			salt = 1
+		}
+	}
+
+	size := f.hashLen()
+	if !f.Binary {
+		size *= 2
+	}
+
+	if len(rowKey) < salt+size {
+		return "", errors.New(fmt.Sprintf("invalid row key [%q]. too short for a hash of %v bytes", rowKey, f.hashLen()))
+	}
+
+	return rowKey[salt : salt+size], nil
+}
+
+// rowRanges returns the ranges of rows of key with buckets in [begin, end),
+// one per salt.
+func (f KeyFormat) rowRanges(key string, begin, end uint32, digits int) []bigtable.RowRange {
+	hash := f.seriesHash(key)
+
+	if f.SaltBuckets == 0 {
+		return []bigtable.RowRange{
+			bigtable.NewRange(f.saltedRowKey(-1, hash, begin, digits), f.saltedRowKey(-1, hash, end, digits)),
+		}
+	}
+
+	var ranges []bigtable.RowRange
+	for salt := 0; salt < f.SaltBuckets; salt++ {
+		ranges = append(ranges,
+			bigtable.NewRange(f.saltedRowKey(salt, hash, begin, digits), f.saltedRowKey(salt, hash, end, digits)))
+	}
+
+	return ranges
+}
+
+// name_qualifier is the column holding the key of the series in rows written with StoreNames.
+const name_qualifier = "name"
+
+// setName stores key in the row of mut if the format stores names.
+func (f KeyFormat) setName(mut *bigtable.Mutation, key string) {
+	if f.StoreNames {
+		mut.Set(column_family, name_qualifier, 0, []byte(key))
+	}
+}
+
+// isName reports whether item is the stored key of the series rather than a point.
+func isName(item bigtable.ReadItem) bool {
+	return qualifier(item) == name_qualifier
+}
+
+// checkName returns an error if row stores the key of another series than key,
+// which means both keys hash to the same row key.
+func checkName(key string, row bigtable.Row) error {
+	for _, e := range row[column_family] {
+		if isName(e) && string(e.Value) != key {
+			err := errors.New(fmt.Sprintf("hash collision. row [%q] of [%v] holds series [%v]", row.Key(), key, string(e.Value)))
+			log.Printf("err [%v]", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks the options of the key format.
+func (f KeyFormat) validate() error {
+	size, found := hashSizes[f.hashName()]
+	if !found {
+		return errors.New(fmt.Sprintf("unknown hash [%v]. should be one of md5, fnv1a, xxhash, murmur3", f.Hash))
+	}
+
+	if f.HashLen < 0 || f.HashLen > size {
+		return errors.New(fmt.Sprintf("invalid hash length [%v] for [%v]. should be between 1 and %v, or 0 for the whole hash",
+			f.HashLen, f.hashName(), size))
+	}
+
+	if f.SaltBuckets < 0 || f.SaltBuckets > maxSaltBuckets {
+		return errors.New(fmt.Sprintf("invalid salt buckets [%v]. should be between 0 and %v", f.SaltBuckets, maxSaltBuckets))
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package btutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeyFormatBinary(t *testing.T) {
+	const fn = "TestKeyFormatBinary"
+
+	format := KeyFormat{Binary: true}
+	buckets := []uint32{0, 255, 256, 416666, 1500000000, 4294967295}
+
+	for i, e := range buckets {
+		rowKey := format.rowKey("key_1", e, epochsecDigits)
+		if len(rowKey) != 20 {
+			t.Errorf("%v: expected 20 bytes, got [%v]", fn, len(rowKey))
+		}
+
+		output, err := format.bucket(rowKey, epochsecDigits)
+		if err != nil || output != e {
+			t.Errorf("%v: expected bucket [%v], got [%v], err [%v]", fn, e, output, err)
+		}
+
+		if i > 0 && format.rowKey("key_1", buckets[i-1], epochsecDigits) >= rowKey {
+			t.Errorf("%v: expected bucket [%v] to sort before [%v]", fn, buckets[i-1], e)
+		}
+	}
+
+	_, err := format.bucket(GetBTKey("key_1", 0), hourDigits)
+	if err == nil {
+		t.Errorf("%v: expected error for text row key", fn)
+	}
+}
+
+func TestKeyFormatText(t *testing.T) {
+	const fn = "TestKeyFormatText"
+
+	kves := KeyValueEpochsec{Series: Series{Name: "key_1"}, Epochsec: 1500000000}
+	if output := (KeyFormat{}).rowKey("key_1", 1500000000, epochsecDigits); output != kves.BTRowKeyStr() {
+		t.Errorf("%v: expected [%v], got [%v]", fn, kves.BTRowKeyStr(), output)
+	}
+	if output := (KeyFormat{}).rowKey("key_1", 1500000000/3600, hourDigits); output != GetBTKey("key_1", 1500000000) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, GetBTKey("key_1", 1500000000), output)
+	}
+}
+
+func TestSchemaPointsBinaryKeys(t *testing.T) {
+	const fn = "TestSchemaPointsBinaryKeys"
+
+	points := []TimeValue{{7200, 1.5}, {7201, 2.5}}
+	ktv := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: points}
+
+	for _, layout := range []string{"hourcol", "hourblob", "hourgorilla"} {
+		schema, _ := NewSchema(layout, KeyFormat{Binary: true})
+
+		rowKeys, _ := schema.Mutations(ktv)
+		if len(rowKeys) != 1 || len(rowKeys[0]) != 20 {
+			t.Errorf("%v: %v: expected 1 binary row key, got [%q]", fn, layout, rowKeys)
+			continue
+		}
+
+		output, err := schema.Points(Series{Name: "key_1"}, writeRow(t, schema, ktv))
+		if err != nil || !reflect.DeepEqual(output, points) {
+			t.Errorf("%v: %v: expected [%v], got [%v], err [%v]", fn, layout, points, output, err)
+		}
+	}
+}
+
+func TestGetBucketKey(t *testing.T) {
+	const fn = "TestGetBucketKey"
+
+	tests := []struct {
+		width    uint32
+		epochsec uint32
+		expected string
+	}{
+		{1, 1500000000, "1500000000"},
+		{600, 1500000000, "2500000"},
+		{3600, 1500000000, "0416666"},
+		{86400, 1500000000, "17361"},
+	}
+
+	for _, e := range tests {
+		output := GetBucketKey("key_1", e.epochsec, e.width)
+		if output[strings.Index(output, "_")+1:] != e.expected {
+			t.Errorf("%v: expected bucket [%v] for width [%v], got [%v]", fn, e.expected, e.width, output)
+		}
+	}
+
+	if GetBucketKey("key_1", 1500000000, 3600) != GetBTKey("key_1", 1500000000) {
+		t.Errorf("%v: expected hour buckets to match GetBTKey", fn)
+	}
+}
+
+func TestSchemaBucketWidth(t *testing.T) {
+	const fn = "TestSchemaBucketWidth"
+
+	points := []TimeValue{{1199, 1}, {1200, 2}, {1799, 3}, {1800, 4}}
+	ktv := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: points}
+	format := KeyFormat{BucketWidth: 600}
+
+	for _, layout := range []string{"hourcol", "hourblob", "hourgorilla"} {
+		schema, _ := NewSchema(layout, format)
+
+		rowKeys, _ := schema.Mutations(ktv)
+		expected := []string{GetBucketKey("key_1", 1199, 600), GetBucketKey("key_1", 1200, 600), GetBucketKey("key_1", 1800, 600)}
+		if !reflect.DeepEqual(rowKeys, expected) {
+			t.Errorf("%v: %v: expected rows [%v], got [%v]", fn, layout, expected, rowKeys)
+		}
+
+		rr := schema.RowRanges(Series{Name: "key_1"}, 1200, 1800)[0]
+		for i, e := range rowKeys {
+			if rr.Contains(e) != (i == 1) {
+				t.Errorf("%v: %v: unexpected row range [%v] for row [%v]", fn, layout, rr, e)
+			}
+		}
+	}
+
+	_, err := NewSchema("hourblob", KeyFormat{BucketWidth: 86400})
+	if err == nil {
+		t.Errorf("%v: expected error for hourblob with day buckets", fn)
+	}
+	_, err = NewSchema("hourblob", KeyFormat{BucketWidth: 65536})
+	if err != nil {
+		t.Errorf("%v: expected hourblob with buckets of 65536 seconds, got err [%v]", fn, err)
+	}
+	_, err = NewSchema("hourgorilla", KeyFormat{BucketWidth: 86400})
+	if err != nil {
+		t.Errorf("%v: expected hourgorilla with day buckets, got err [%v]", fn, err)
+	}
+}
+
+func TestKeyFormatSalt(t *testing.T) {
+	const fn = "TestKeyFormatSalt"
+
+	for _, binary := range []bool{false, true} {
+		format := KeyFormat{Binary: binary, SaltBuckets: 8}
+		schema, err := NewSchema("sec", format)
+		if err != nil {
+			t.Fatalf("%v: cannot create schema, err [%v]", fn, err)
+		}
+
+		var points []TimeValue
+		for i := uint32(0); i < 16; i++ {
+			points = append(points, TimeValue{1500000000 + i, float64(i)})
+		}
+		rowKeys, _ := schema.Mutations(KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: points})
+
+		salts := make(map[string]bool)
+		for i, e := range rowKeys {
+			if binary {
+				salts[e[:1]] = true
+			} else {
+				salts[e[:2]] = true
+			}
+
+			bucket, err := format.bucket(e, epochsecDigits)
+			if err != nil || bucket != points[i].Epochsec {
+				t.Errorf("%v: expected bucket [%v] from [%q], got [%v], err [%v]", fn, points[i].Epochsec, e, bucket, err)
+			}
+		}
+		if len(salts) != 8 {
+			t.Errorf("%v: expected rows spread over 8 salts, got [%v]", fn, len(salts))
+		}
+
+		ranges := schema.RowRanges(Series{Name: "key_1"}, 1500000000, 1500000010)
+		if len(ranges) != 8 {
+			t.Errorf("%v: expected 8 row ranges, got [%v]", fn, len(ranges))
+		}
+		for i, e := range rowKeys {
+			var n int
+			for _, rr := range ranges {
+				if rr.Contains(e) {
+					n++
+				}
+			}
+			if expected := map[bool]int{true: 1, false: 0}[i < 10]; n != expected {
+				t.Errorf("%v: expected row [%q] in [%v] ranges, got [%v]", fn, e, expected, n)
+			}
+		}
+	}
+
+	if _, err := NewSchema("sec", KeyFormat{SaltBuckets: 257}); err == nil {
+		t.Errorf("%v: expected error for 257 salt buckets", fn)
+	}
+}
@@ -0,0 +1,119 @@
+package btutil
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy is how the rows of a bulk write failing with retryable errors
+// are written again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of writes of a row before it fails. 0 or 1 never retries.
+	MaxAttempts int
+	// InitialBackoff is the longest wait before the first retry. The longest
+	// wait doubles with every retry up to MaxBackoff, and the actual wait is
+	// a random fraction of it.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// backoff returns the wait before the retry following attempt, with full jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	max := float64(p.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	if max > float64(p.MaxBackoff) {
+		max = float64(p.MaxBackoff)
+	}
+	if max < 1 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// retryableCodes are the grpc codes of the errors worth writing a row again for.
+var retryableCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.DeadlineExceeded:  true,
+	codes.Aborted:           true,
+	codes.ResourceExhausted: true,
+}
+
+// retryable returns whether the write of a row failing with err may succeed when retried.
+func retryable(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && retryableCodes[s.Code()]
+}
+
+// FailedRow is a row that could not be written.
+type FailedRow struct {
+	RowKey   string
+	Err      error
+	Attempts int
+}
+
+// bulkApplier applies mutations to rows, like *bigtable.Table.
+type bulkApplier interface {
+	ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation,
+		opts ...bigtable.ApplyOption) ([]error, error)
+}
+
+// applyWithRetry applies muts to rowKeys, retrying only the rows failing with
+// retryable errors as per policy, and returns the rows that failed.
+func applyWithRetry(ctx context.Context, tbl bulkApplier, policy RetryPolicy, rowKeys []string,
+	muts []*bigtable.Mutation) []FailedRow {
+
+	var failed []FailedRow
+	for attempt := 1; ; attempt++ {
+		errs, err := tbl.ApplyBulk(ctx, rowKeys, muts)
+		if err != nil {
+			log.Printf("entire bulk mutation failed. err [%v]", err)
+			errs = make([]error, len(rowKeys))
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+
+		var retryKeys []string
+		var retryMuts []*bigtable.Mutation
+		for i, e := range errs {
+			if e == nil {
+				continue
+			}
+			if attempt < policy.MaxAttempts && retryable(e) && ctx.Err() == nil {
+				retryKeys = append(retryKeys, rowKeys[i])
+				retryMuts = append(retryMuts, muts[i])
+				continue
+			}
+			failed = append(failed, FailedRow{rowKeys[i], e, attempt})
+		}
+		if len(retryKeys) == 0 {
+			return failed
+		}
+
+		backoff := policy.backoff(attempt)
+		log.Printf("retrying [%v] of [%v] rows in [%v], attempt [%v]", len(retryKeys), len(rowKeys), backoff, attempt)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			for _, e := range retryKeys {
+				failed = append(failed, FailedRow{e, ctx.Err(), attempt})
+			}
+			return failed
+		}
+		rowKeys, muts = retryKeys, retryMuts
+	}
+}
+
+// logDeadLetters is the default dead letter report, logging every failed row.
+func logDeadLetters(rows []FailedRow) {
+	for _, e := range rows {
+		log.Printf("dead letter: write of rowkey [%v] failed after [%v] attempts, err [%v]", e.RowKey, e.Attempts, e.Err)
+	}
+}
@@ -0,0 +1,145 @@
+package btutil
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeApplier fails the writes of a row with the errors listed for it, in
+// order, and succeeds once they are used up.
+type fakeApplier struct {
+	errs  map[string][]error
+	calls [][]string
+}
+
+func (f *fakeApplier) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation,
+	opts ...bigtable.ApplyOption) ([]error, error) {
+
+	f.calls = append(f.calls, rowKeys)
+
+	var result []error
+	failed := false
+	for _, e := range rowKeys {
+		var err error
+		if len(f.errs[e]) > 0 {
+			err = f.errs[e][0]
+			f.errs[e] = f.errs[e][1:]
+			failed = true
+		}
+		result = append(result, err)
+	}
+	if !failed {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func TestApplyWithRetry(t *testing.T) {
+	const fn = "TestApplyWithRetry"
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	invalid := status.Error(codes.InvalidArgument, "invalid")
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		errs   map[string][]error
+		// calls are the row keys written by every call of ApplyBulk
+		calls  [][]string
+		failed []FailedRow
+	}{
+		{"no errors", policy, nil, [][]string{{"a", "b", "c"}}, nil},
+		{"retried", policy, map[string][]error{"b": {unavailable, unavailable}},
+			[][]string{{"a", "b", "c"}, {"b"}, {"b"}}, nil},
+		{"not retryable", policy, map[string][]error{"a": {invalid}, "c": {unavailable}},
+			[][]string{{"a", "b", "c"}, {"c"}}, []FailedRow{{"a", invalid, 1}}},
+		{"max attempts", policy, map[string][]error{"c": {unavailable, unavailable, unavailable}},
+			[][]string{{"a", "b", "c"}, {"c"}, {"c"}}, []FailedRow{{"c", unavailable, 3}}},
+		{"no retries", RetryPolicy{}, map[string][]error{"b": {unavailable}},
+			[][]string{{"a", "b", "c"}}, []FailedRow{{"b", unavailable, 1}}},
+	}
+
+	for _, test := range tests {
+		tbl := &fakeApplier{errs: test.errs}
+		muts := []*bigtable.Mutation{bigtable.NewMutation(), bigtable.NewMutation(), bigtable.NewMutation()}
+		failed := applyWithRetry(context.Background(), tbl, test.policy, []string{"a", "b", "c"}, muts)
+		if !reflect.DeepEqual(tbl.calls, test.calls) {
+			t.Errorf("%v: %v: calls are [%v], expected [%v]", fn, test.name, tbl.calls, test.calls)
+		}
+		if !reflect.DeepEqual(failed, test.failed) {
+			t.Errorf("%v: %v: failed rows are [%v], expected [%v]", fn, test.name, failed, test.failed)
+		}
+	}
+}
+
+func TestApplyWithRetryCancelled(t *testing.T) {
+	const fn = "TestApplyWithRetryCancelled"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tbl := &fakeApplier{errs: map[string][]error{"a": {status.Error(codes.Unavailable, "unavailable")}}}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	failed := applyWithRetry(ctx, tbl, policy, []string{"a"}, []*bigtable.Mutation{bigtable.NewMutation()})
+	if len(tbl.calls) != 1 || len(failed) != 1 || failed[0].RowKey != "a" {
+		t.Errorf("%v: calls [%v], failed rows [%v]. expected one call and row a failed", fn, tbl.calls, failed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	const fn = "TestBackoff"
+
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{9, 50 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := policy.backoff(test.attempt)
+			if backoff < 0 || backoff >= test.max {
+				t.Errorf("%v: backoff of attempt [%v] is [%v], expected in [0, %v)", fn, test.attempt, backoff, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	const fn = "TestRetryable"
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{status.Error(codes.Unavailable, ""), true},
+		{status.Error(codes.DeadlineExceeded, ""), true},
+		{status.Error(codes.Aborted, ""), true},
+		{status.Error(codes.ResourceExhausted, ""), true},
+		{status.Error(codes.InvalidArgument, ""), false},
+		{status.Error(codes.NotFound, ""), false},
+		{errors.New("not a grpc error"), false},
+	}
+
+	for _, test := range tests {
+		actual := retryable(test.err)
+		if actual != test.expected {
+			t.Errorf("%v: retryable of [%v] is [%v], expected [%v]", fn, test.err, actual, test.expected)
+		}
+	}
+}
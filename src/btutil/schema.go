@@ -0,0 +1,119 @@
+package btutil
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const column_family = "0"
+
+// RowKeySchema maps the points of a series to bigtable rows and back. Each
+// implementation is one storage layout, so that writers and readers can pick
+// the layout on the command line instead of hard-coding it.
+type RowKeySchema interface {
+	// Name returns the name the schema is selected by.
+	Name() string
+
+	// Format returns the format of the row keys of the schema.
+	Format() KeyFormat
+
+	// Mutations encodes the points of a series into row keys and the mutations to apply to them.
+	Mutations(ktv KeyTimevalues) ([]string, []*bigtable.Mutation)
+
+	// RowKey returns the key of the row Mutations writes the point of series at epochsec to.
+	RowKey(series Series, epochsec uint32) string
+
+	// Points decodes a row of series written by Mutations. It returns an error
+	// if the row holds another series colliding on the hash of series.
+	Points(series Series, row bigtable.Row) ([]TimeValue, error)
+
+	// RowRanges returns the ranges of rows holding the points of series in
+	// [from, until). There is one range per salt bucket of the key format, each
+	// to be read separately and merged.
+	RowRanges(series Series, from, until uint32) []bigtable.RowRange
+}
+
+// NewSchema returns the schema for the given layout name, building row keys in the given format.
+func NewSchema(layout string, format KeyFormat) (RowKeySchema, error) {
+	err := format.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch layout {
+	case "sec":
+		return secSchema{format}, nil
+	case "hourcol":
+		return hourColSchema{format}, nil
+	case "hourblob", "hourgorilla":
+		// hourblob stores the offsets of points in their bucket as uint16
+		if layout == "hourblob" && format.width() > math.MaxUint16+1 {
+			return nil, errors.New(fmt.Sprintf("bucket width [%v] too large for %v. should be at most %v",
+				format.width(), layout, math.MaxUint16+1))
+		}
+		return hourBlobSchema{format: format, gorilla: layout == "hourgorilla"}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unknown schema [%v]. should be one of sec, hourcol, hourblob, hourgorilla", layout))
+}
+
+// SchemaFlags holds the command line flags selecting a RowKeySchema.
+type SchemaFlags struct {
+	layout      *string
+	binaryKeys  *bool
+	bucketWidth *time.Duration
+	hash        *string
+	hashLen     *int
+	storeNames  *bool
+	saltBuckets *int
+}
+
+// NewSchemaFlags registers the schema flags. It must be called before flag.Parse.
+func NewSchemaFlags(defaultLayout string) *SchemaFlags {
+	return &SchemaFlags{
+		layout:     flag.String("schema", defaultLayout, "Row key schema: sec, hourcol, hourblob or hourgorilla."),
+		binaryKeys: flag.Bool("binary_keys", false, "Use binary row keys: raw hash bytes and big endian time bucket."),
+		bucketWidth: flag.Duration("bucket_width", time.Hour,
+			"Time covered by a row of the hourcol, hourblob and hourgorilla schemas, in whole seconds."),
+		hash:       flag.String("hash", "md5", "Hash of the series key in row keys: md5, fnv1a, xxhash or murmur3."),
+		hashLen:    flag.Int("hash_len", 0, "Bytes of the hash kept in row keys. 0 keeps the whole hash."),
+		storeNames: flag.Bool("store_names", false, "Store the series key in every row to detect hash collisions."),
+		saltBuckets: flag.Int("salt_buckets", 0,
+			"Spread the rows of every series over this many salted key prefixes, at most 256. 0 disables salting."),
+	}
+}
+
+// Schema returns the schema selected by the parsed flags. It exits if the flags are invalid.
+func (f *SchemaFlags) Schema() RowKeySchema {
+	width := *f.bucketWidth / time.Second
+	if width <= 0 || width > math.MaxUint32 || width*time.Second != *f.bucketWidth {
+		log.Fatalf("invalid bucket width [%v]. should be a positive number of seconds", *f.bucketWidth)
+	}
+	format := KeyFormat{
+		Binary:      *f.binaryKeys,
+		BucketWidth: uint32(width),
+		Hash:        *f.hash,
+		HashLen:     *f.hashLen,
+		StoreNames:  *f.storeNames,
+		SaltBuckets: *f.saltBuckets,
+	}
+
+	schema, err := NewSchema(*f.layout, format)
+	if err != nil {
+		log.Fatalf("cannot create schema, err [%v]", err)
+	}
+
+	log.Printf("using schema [%v], key format %+v", schema.Name(), format)
+	return schema
+}
+
+// qualifier strips the column family from the column of a read item.
+func qualifier(item bigtable.ReadItem) string {
+	return item.Column[len(column_family)+1:]
+}
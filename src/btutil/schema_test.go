@@ -0,0 +1,233 @@
+package btutil
+
+import (
+	"btemulator"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+func TestGroupBySeries(t *testing.T) {
+	const fn = "TestGroupBySeries"
+
+	input := []KeyValueEpochsec{
+		{Series: Series{Name: "a"}, Value: 1, Epochsec: 100},
+		{Series: Series{Name: "b"}, Value: 2, Epochsec: 100},
+		{Series: Series{Name: "a"}, Value: 3, Epochsec: 101},
+	}
+	expected := []KeyTimevalues{
+		{Series{Name: "a"}, []TimeValue{{100, 1}, {101, 3}}},
+		{Series{Name: "b"}, []TimeValue{{100, 2}}},
+	}
+
+	output := GroupBySeries(input)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, output)
+	}
+}
+
+func TestSchemaPoints(t *testing.T) {
+	const fn = "TestSchemaPoints"
+
+	points := []TimeValue{{7200, 1.5}, {7201, 2.5}, {10799, -3}}
+	ktv := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: points}
+
+	for _, layout := range []string{"hourcol", "hourblob", "hourgorilla"} {
+		schema, err := NewSchema(layout, KeyFormat{})
+		if err != nil {
+			t.Fatalf("%v: cannot create schema [%v], err [%v]", fn, layout, err)
+		}
+
+		rowKeys, muts := schema.Mutations(ktv)
+		if len(rowKeys) != 1 || len(muts) != 1 {
+			t.Errorf("%v: %v: expected 1 row, got [%v]", fn, layout, rowKeys)
+			continue
+		}
+		if rowKeys[0] != GetBTKey(ktv.Series.String(), 7200) {
+			t.Errorf("%v: %v: expected row key [%v], got [%v]", fn, layout, GetBTKey(ktv.Series.String(), 7200), rowKeys[0])
+		}
+
+		row := writeRow(t, schema, ktv)
+		output, err := schema.Points(Series{Name: "key_1"}, row)
+		if err != nil {
+			t.Errorf("%v: %v: cannot decode row, err [%v]", fn, layout, err)
+		}
+		if !reflect.DeepEqual(output, points) {
+			t.Errorf("%v: %v: expected [%v], got [%v]", fn, layout, points, output)
+		}
+	}
+}
+
+// writeRows writes ktv with the mutations of schema to a new table of the
+// bigtable emulator, and returns the table with its rows as they are read back.
+func writeRows(t *testing.T, schema RowKeySchema, ktvs ...KeyTimevalues) (*bigtable.Table, []bigtable.Row) {
+	ctx := context.Background()
+	tbl := btemulator.Table(t, "test")
+
+	var rows []bigtable.Row
+	for _, ktv := range ktvs {
+		rowKeys, muts := schema.Mutations(ktv)
+		errs, err := tbl.ApplyBulk(ctx, rowKeys, muts)
+		if err != nil || errs != nil {
+			t.Fatalf("cannot write [%v], err [%v], errs [%v]", ktv, err, errs)
+		}
+
+		for _, e := range rowKeys {
+			row, err := tbl.ReadRow(ctx, e)
+			if err != nil {
+				t.Fatalf("cannot read row [%v], err [%v]", e, err)
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	return tbl, rows
+}
+
+// writeRow writes ktv, which must fit in a row, and returns the row read back.
+func writeRow(t *testing.T, schema RowKeySchema, ktv KeyTimevalues) bigtable.Row {
+	_, rows := writeRows(t, schema, ktv)
+	return rows[0]
+}
+
+func TestSplitByBucket(t *testing.T) {
+	const fn = "TestSplitByBucket"
+
+	tests := []struct {
+		name     string
+		input    []TimeValue
+		expected [][]TimeValue
+	}{
+		{"same hour", []TimeValue{{3600, 1}, {7199, 2}},
+			[][]TimeValue{{{3600, 1}, {7199, 2}}}},
+		{"one boundary", []TimeValue{{7198, 1}, {7199, 2}, {7200, 3}, {7201, 4}},
+			[][]TimeValue{{{7198, 1}, {7199, 2}}, {{7200, 3}, {7201, 4}}}},
+		{"several boundaries", []TimeValue{{3599, 1}, {3600, 2}, {7200, 3}, {14400, 4}},
+			[][]TimeValue{{{3599, 1}}, {{3600, 2}}, {{7200, 3}}, {{14400, 4}}}},
+		{"out of order", []TimeValue{{7200, 1}, {3600, 2}, {7201, 3}},
+			[][]TimeValue{{{7200, 1}, {7201, 3}}, {{3600, 2}}}},
+	}
+
+	for _, e := range tests {
+		output := SplitByBucket(KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: e.input}, 3600)
+		if len(output) != len(e.expected) {
+			t.Errorf("%v: %v: expected [%v] hours, got [%v]", fn, e.name, len(e.expected), len(output))
+			continue
+		}
+		for i := range output {
+			if output[i].Series.Name != "key_1" || !reflect.DeepEqual(output[i].Timevalues, e.expected[i]) {
+				t.Errorf("%v: %v: expected [%v] at [%v], got [%v]", fn, e.name, e.expected[i], i, output[i])
+			}
+		}
+	}
+}
+
+func TestHourBlobMutationsStraddlingHours(t *testing.T) {
+	const fn = "TestHourBlobMutationsStraddlingHours"
+
+	points := []TimeValue{{7190, 1}, {7199, 2}, {7200, 3}, {10800, 4}, {10805, 5}}
+	ktv := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: points}
+	expectedRows := []string{GetBTKey("key_1", 7190), GetBTKey("key_1", 7200), GetBTKey("key_1", 10800)}
+
+	for _, layout := range []string{"hourcol", "hourblob", "hourgorilla"} {
+		schema, _ := NewSchema(layout, KeyFormat{})
+
+		rowKeys, muts := schema.Mutations(ktv)
+		if !reflect.DeepEqual(rowKeys, expectedRows) || len(muts) != len(rowKeys) {
+			t.Errorf("%v: %v: expected rows [%v], got [%v] with [%v] mutations", fn, layout, expectedRows, rowKeys, len(muts))
+			continue
+		}
+
+		var decoded []TimeValue
+		_, rows := writeRows(t, schema, ktv)
+		for _, row := range rows {
+			output, err := schema.Points(Series{Name: "key_1"}, row)
+			if err != nil {
+				t.Errorf("%v: %v: cannot decode row, err [%v]", fn, layout, err)
+			}
+			decoded = append(decoded, output...)
+		}
+		if !reflect.DeepEqual(decoded, points) {
+			t.Errorf("%v: %v: expected [%v], got [%v]", fn, layout, points, decoded)
+		}
+	}
+}
+
+func TestMergePoints(t *testing.T) {
+	const fn = "TestMergePoints"
+
+	input := []TimeValue{{7210, 3}, {7200, 1}, {7205, 2}, {7200, 4}}
+	expected := []TimeValue{{7200, 4}, {7205, 2}, {7210, 3}}
+
+	output := MergePoints(input)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("%v: expected [%v], got [%v]", fn, expected, output)
+	}
+}
+
+func TestHourBlobPointsSameSecond(t *testing.T) {
+	const fn = "TestHourBlobPointsSameSecond"
+
+	ctx := context.Background()
+	tbl := btemulator.Table(t, "blob")
+	for _, layout := range []string{"hourblob", "hourgorilla"} {
+		schema, _ := NewSchema(layout, KeyFormat{})
+
+		// whatever the order of the md5 of the blobs, the newest one wins
+		for i, values := range [][]float64{{1, 2}, {2, 1}, {3, 4}, {4, 3}} {
+			series := Series{Name: layout + "_" + strconv.Itoa(i)}
+			for _, e := range values {
+				keys, muts := schema.Mutations(KeyTimevalues{series, []TimeValue{{7200, e}}})
+				errs, err := tbl.ApplyBulk(ctx, keys, muts)
+				if err != nil || errs != nil {
+					t.Fatalf("%v: %v: cannot write, err [%v], errs [%v]", fn, layout, err, errs)
+				}
+			}
+
+			row, err := tbl.ReadRow(ctx, GetBTKey(series.String(), 7200), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+			if err != nil {
+				t.Fatalf("%v: %v: cannot read row, err [%v]", fn, layout, err)
+			}
+			output, err := schema.Points(series, row)
+			expected := []TimeValue{{7200, values[1]}}
+			if err != nil || !reflect.DeepEqual(output, expected) {
+				t.Errorf("%v: %v: writing %v, expected [%v], got [%v], err [%v]", fn, layout, values, expected, output, err)
+			}
+		}
+	}
+}
+
+func TestHourBlobPointsSeveralBlobs(t *testing.T) {
+	const fn = "TestHourBlobPointsSeveralBlobs"
+
+	rowKey := GetBTKey("key_1", 7200)
+	first := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: []TimeValue{{7200, 1}, {7260, 2}}}
+	second := KeyTimevalues{Series: Series{Name: "key_1"}, Timevalues: []TimeValue{{7230, 3}, {7290, 4}}}
+	expected := []TimeValue{{7200, 1}, {7230, 3}, {7260, 2}, {7290, 4}}
+
+	for _, layout := range []string{"hourblob", "hourgorilla"} {
+		schema, _ := NewSchema(layout, KeyFormat{})
+
+		tbl, _ := writeRows(t, schema, first, second)
+		row, err := tbl.ReadRow(context.Background(), rowKey)
+		if err != nil {
+			t.Fatalf("%v: %v: cannot read row, err [%v]", fn, layout, err)
+		}
+
+		output, err := schema.Points(Series{Name: "key_1"}, row)
+		if err != nil {
+			t.Errorf("%v: %v: cannot decode row, err [%v]", fn, layout, err)
+		}
+		if !reflect.DeepEqual(output, expected) {
+			t.Errorf("%v: %v: expected [%v], got [%v]", fn, layout, expected, output)
+		}
+
+		windowed := FilterWindow(output, 7230, 7290)
+		if !reflect.DeepEqual(windowed, expected[1:3]) {
+			t.Errorf("%v: %v: expected [%v] in window, got [%v]", fn, layout, expected[1:3], windowed)
+		}
+	}
+}
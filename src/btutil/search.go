@@ -0,0 +1,177 @@
+package btutil
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Matcher selects series in a search of the series index.
+type Matcher interface {
+	Matches(series Series) bool
+}
+
+// globMatcher matches series names against a Graphite glob.
+type globMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m globMatcher) Matches(series Series) bool {
+	return m.re.MatchString(series.Name)
+}
+
+// NewGlobMatcher returns a matcher of the series whose name matches a Graphite
+// glob such as servers.*.cpu.{user,sys}. Names are dot separated nodes: * and ?
+// match any characters or any one character within a node, [...] matches a
+// character class and {a,b} matches either alternative.
+func NewGlobMatcher(glob string) (Matcher, error) {
+	re, err := regexp.Compile("^" + globToRegexp(glob) + "$")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid glob [%v], err [%v]", glob, err))
+	}
+
+	return globMatcher{re}, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	var inAlternation, inClass bool
+	for _, c := range glob {
+		switch {
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteRune(c)
+		case c == '*':
+			b.WriteString(`[^.]*`)
+		case c == '?':
+			b.WriteString(`[^.]`)
+		case c == '[':
+			inClass = true
+			b.WriteRune(c)
+		case c == '{':
+			inAlternation = true
+			b.WriteString(`(?:`)
+		case c == '}' && inAlternation:
+			inAlternation = false
+			b.WriteString(`)`)
+		case c == ',' && inAlternation:
+			b.WriteString(`|`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// regexMatcher matches the serialization of series against a regular expression.
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexMatcher) Matches(series Series) bool {
+	return m.re.MatchString(series.String())
+}
+
+// NewRegexMatcher returns a matcher of the series whose serialization, see
+// Series.String, contains a match of the regular expression expr.
+func NewRegexMatcher(expr string) (Matcher, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid regex [%v], err [%v]", expr, err))
+	}
+
+	return regexMatcher{re}, nil
+}
+
+// name_label is the label name tag matchers use for the name of the series.
+const name_label = "__name__"
+
+// tagMatcher matches the value of a label, Prometheus style.
+type tagMatcher struct {
+	label  string
+	negate bool
+	value  string
+	re     *regexp.Regexp
+}
+
+func (m tagMatcher) Matches(series Series) bool {
+	// a missing label matches as an empty value
+	value := series.Name
+	if m.label != name_label {
+		value, _ = series.Label(m.label)
+	}
+
+	var matches bool
+	if m.re != nil {
+		matches = m.re.MatchString(value)
+	} else {
+		matches = value == m.value
+	}
+
+	return matches != m.negate
+}
+
+// NewTagMatcher returns a matcher of the series whose label matches expr, one
+// of label=value, label!=value, label=~regex or label!~regex. Regexes match
+// the whole value. The label __name__ is the name of the series.
+func NewTagMatcher(expr string) (Matcher, error) {
+	// label names hold neither ! nor =, so the operator starts at the first of them
+	i := strings.IndexAny(expr, "!=")
+	if i > 0 {
+		for _, op := range tagOps {
+			if strings.HasPrefix(expr[i:], op) {
+				return NewLabelMatcher(expr[:i], op, expr[i+len(op):])
+			}
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("invalid tag matcher [%v]. should be label=value, label!=value, "+
+		"label=~regex or label!~regex", expr))
+}
+
+var tagOps = []string{"!~", "=~", "!=", "="}
+
+// NewLabelMatcher returns a matcher of the series whose label matches value
+// with op, one of =, !=, =~ or !~, see NewTagMatcher.
+func NewLabelMatcher(label, op, value string) (Matcher, error) {
+	m := tagMatcher{label: label, negate: strings.HasPrefix(op, "!"), value: value}
+	switch op {
+	case "=", "!=":
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid regex [%v] of label [%v], err [%v]", value, label, err))
+		}
+		m.re = re
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid label matcher operator [%v]", op))
+	}
+
+	return m, nil
+}
+
+// Search returns the series of the index matching all matchers.
+func Search(ctx context.Context, index *SeriesIndex, matchers ...Matcher) ([]SeriesInfo, error) {
+	var result []SeriesInfo
+	err := index.List(ctx, func(info SeriesInfo) bool {
+		for _, m := range matchers {
+			if !m.Matches(info.Series) {
+				return true
+			}
+		}
+
+		result = append(result, info)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
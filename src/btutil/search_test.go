@@ -0,0 +1,91 @@
+package btutil
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMatchers(t *testing.T) {
+	const fn = "TestMatchers"
+
+	tests := []struct {
+		kind     string
+		expr     string
+		series   Series
+		expected bool
+	}{
+		{"glob", "servers.*.cpu.{user,sys}", Series{Name: "servers.a1.cpu.user"}, true},
+		{"glob", "servers.*.cpu.{user,sys}", Series{Name: "servers.a1.cpu.sys"}, true},
+		{"glob", "servers.*.cpu.{user,sys}", Series{Name: "servers.a1.cpu.idle"}, false},
+		{"glob", "servers.*.cpu.{user,sys}", Series{Name: "servers.a.b.cpu.user"}, false},
+		{"glob", "servers.web?.cpu", Series{Name: "servers.web1.cpu"}, true},
+		{"glob", "servers.web[0-4].cpu", Series{Name: "servers.web5.cpu"}, false},
+		{"glob", "key_1+", Series{Name: "key_11"}, false},
+		{"glob", "key_1+", Series{Name: "key_1+"}, true},
+		{"regex", `^key_\d$`, Series{Name: "key_7"}, true},
+		{"regex", `host="a"`, NewSeries("cpu", map[string]string{"host": "a"}), true},
+		{"regex", `^key_\d$`, Series{Name: "key_17"}, false},
+		{"tag", "host=a", NewSeries("cpu", map[string]string{"host": "a"}), true},
+		{"tag", "host!=a", NewSeries("cpu", map[string]string{"host": "a"}), false},
+		{"tag", "host=~a|b", NewSeries("cpu", map[string]string{"host": "b"}), true},
+		{"tag", "host=~a", NewSeries("cpu", map[string]string{"host": "ab"}), false},
+		{"tag", "host!~a.*", NewSeries("cpu", map[string]string{"host": "ab"}), false},
+		{"tag", "host=", Series{Name: "cpu"}, true},
+		{"tag", "__name__=~cpu|mem", Series{Name: "mem"}, true},
+		{"tag", "host=a!~b", NewSeries("cpu", map[string]string{"host": "a!~b"}), true},
+	}
+
+	for _, e := range tests {
+		var m Matcher
+		var err error
+		switch e.kind {
+		case "glob":
+			m, err = NewGlobMatcher(e.expr)
+		case "regex":
+			m, err = NewRegexMatcher(e.expr)
+		case "tag":
+			m, err = NewTagMatcher(e.expr)
+		}
+		if err != nil {
+			t.Errorf("%v: cannot create %v matcher [%v], err [%v]", fn, e.kind, e.expr, err)
+			continue
+		}
+
+		if m.Matches(e.series) != e.expected {
+			t.Errorf("%v: %v [%v]: expected [%v] for [%v]", fn, e.kind, e.expr, e.expected, e.series)
+		}
+	}
+
+	for _, e := range []string{"host", "=a", "host=~(", "host!a"} {
+		if _, err := NewTagMatcher(e); err == nil {
+			t.Errorf("%v: expected error for tag matcher [%v]", fn, e)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	const fn = "TestSearch"
+
+	ctx := context.Background()
+	index := NewSeriesIndex(emulatorTable(t, "index"), KeyFormat{})
+
+	var slice []KeyTimevalues
+	for _, e := range []Series{
+		NewSeries("servers.a.cpu.user", map[string]string{"dc": "east"}),
+		NewSeries("servers.b.cpu.user", map[string]string{"dc": "west"}),
+		NewSeries("servers.b.cpu.idle", map[string]string{"dc": "west"}),
+	} {
+		slice = append(slice, KeyTimevalues{e, []TimeValue{{1000, 1}}})
+	}
+	if err := index.Update(ctx, slice); err != nil {
+		t.Fatalf("%v: cannot update index, err [%v]", fn, err)
+	}
+
+	glob, _ := NewGlobMatcher("servers.*.cpu.{user,sys}")
+	tag, _ := NewTagMatcher("dc=west")
+	result, err := Search(ctx, index, glob, tag)
+	if err != nil || len(result) != 1 || result[0].Series.Name != "servers.b.cpu.user" {
+		t.Errorf("%v: expected servers.b.cpu.user, got [%+v], err [%v]", fn, result, err)
+	}
+}
@@ -0,0 +1,76 @@
+package btutil
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// secSchema stores one point per row, keyed by md5_epochsec, in column 0:0.
+type secSchema struct {
+	format KeyFormat
+}
+
+func (secSchema) Name() string {
+	return "sec"
+}
+
+func (s secSchema) Format() KeyFormat {
+	return s.format
+}
+
+func (s secSchema) Mutations(ktv KeyTimevalues) ([]string, []*bigtable.Mutation) {
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	key := ktv.Series.String()
+	for _, e := range ktv.Timevalues {
+		kves := KeyValueEpochsec{Series: ktv.Series, Value: e.Value, Epochsec: e.Epochsec}
+
+		mut := bigtable.NewMutation()
+		mut.Set(column_family, "0", 0, kves.ValueByteArray())
+		s.format.setName(mut, key)
+
+		muts = append(muts, mut)
+		rowKeys = append(rowKeys, s.format.rowKey(key, e.Epochsec, epochsecDigits))
+	}
+
+	return rowKeys, muts
+}
+
+func (s secSchema) RowKey(series Series, epochsec uint32) string {
+	return s.format.rowKey(series.String(), epochsec, epochsecDigits)
+}
+
+func (s secSchema) Points(series Series, row bigtable.Row) ([]TimeValue, error) {
+	epochsec, err := s.format.bucket(row.Key(), epochsecDigits)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkName(series.String(), row)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range row[column_family] {
+		if isName(e) {
+			continue
+		}
+
+		// cells are returned newest first
+		var value float64
+		err = binary.Read(bytes.NewReader(e.Value), binary.BigEndian, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		return []TimeValue{{epochsec, value}}, nil
+	}
+
+	return nil, nil
+}
+
+func (s secSchema) RowRanges(series Series, from, until uint32) []bigtable.RowRange {
+	return s.format.rowRanges(series.String(), from, until, epochsecDigits)
+}
@@ -0,0 +1,164 @@
+package btutil
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label is a name value pair qualifying a series, as in Prometheus.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Series identifies a time series by its name and its labels, sorted by label name.
+type Series struct {
+	Name   string
+	Labels []Label
+}
+
+// NewSeries returns the series with the given name and labels.
+func NewSeries(name string, labels map[string]string) Series {
+	s := Series{Name: name}
+	for k, v := range labels {
+		s.Labels = append(s.Labels, Label{k, v})
+	}
+	sort.Slice(s.Labels, func(i, j int) bool {
+		return s.Labels[i].Name < s.Labels[j].Name
+	})
+
+	return s
+}
+
+// Label returns the value of the label with the given name, and whether the series has it.
+func (s Series) Label(name string) (string, bool) {
+	for _, e := range s.Labels {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// String returns the canonical serialization of the series, name{a="1",b="2"},
+// which is hashed into row keys. Backslashes and the braces, commas, equal
+// signs and quotes delimiting names are escaped with a backslash, so that two
+// series never serialize the same. A series without labels serializes to its
+// name alone, so that its row keys are those of a plain key, unless the name
+// holds a backslash or an opening brace to escape.
+func (s Series) String() string {
+	if len(s.Labels) == 0 {
+		return escapeName(s.Name, "{")
+	}
+
+	labels := s.Labels
+	if !sort.SliceIsSorted(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name }) {
+		labels = append([]Label(nil), labels...)
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+	}
+
+	var b strings.Builder
+	b.WriteString(escapeName(s.Name, "{"))
+	b.WriteByte('{')
+	for i, e := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(escapeName(e.Name, `{},="`))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(e.Value))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// ParseSeries parses the serialization of a series written by String.
+func ParseSeries(str string) (Series, error) {
+	name, i, err := cutName(str, '{')
+	if err != nil {
+		return Series{}, errors.New(fmt.Sprintf("invalid series [%v], err [%v]", str, err))
+	}
+	if i == -1 {
+		return Series{Name: name}, nil
+	}
+
+	s := Series{Name: name}
+	rest := str[i+1:]
+	for {
+		if rest == "}" && len(s.Labels) > 0 {
+			break
+		}
+
+		name, eq, err := cutName(rest, '=')
+		if err != nil || eq <= 0 {
+			return Series{}, errors.New(fmt.Sprintf("invalid series [%v]. should be name{label=\"value\",...}", str))
+		}
+
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return Series{}, errors.New(fmt.Sprintf("invalid value of label [%v] in series [%v]", name, str))
+		}
+		value, _ := strconv.Unquote(quoted)
+
+		if _, found := s.Label(name); found {
+			return Series{}, errors.New(fmt.Sprintf("duplicate label [%v] in series [%v]", name, str))
+		}
+		s.Labels = append(s.Labels, Label{name, value})
+
+		rest = rest[eq+1+len(quoted):]
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if rest != "}" {
+			return Series{}, errors.New(fmt.Sprintf("invalid series [%v]. should be name{label=\"value\",...}", str))
+		}
+	}
+
+	sort.Slice(s.Labels, func(i, j int) bool {
+		return s.Labels[i].Name < s.Labels[j].Name
+	})
+	return s, nil
+}
+
+// escapeName escapes the backslashes of name and its bytes in special with a
+// backslash.
+func escapeName(name, special string) string {
+	if !strings.ContainsAny(name, special+`\`) {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' || strings.IndexByte(special, name[i]) != -1 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// cutName returns the name escaped by escapeName at the start of str, up to
+// the first sep not escaped, and the index of that sep, -1 if there is none.
+func cutName(str string, sep byte) (string, int, error) {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			i++
+			if i == len(str) {
+				return "", 0, errors.New("trailing backslash")
+			}
+		case sep:
+			return b.String(), i, nil
+		}
+		b.WriteByte(str[i])
+	}
+
+	return b.String(), -1, nil
+}
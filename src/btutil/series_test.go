@@ -0,0 +1,84 @@
+package btutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeriesString(t *testing.T) {
+	const fn = "TestSeriesString"
+
+	tests := []struct {
+		series   Series
+		expected string
+	}{
+		{Series{Name: "key_1"}, "key_1"},
+		{NewSeries("cpu", map[string]string{"mode": "user", "host": "a"}), `cpu{host="a",mode="user"}`},
+		{Series{Name: "cpu", Labels: []Label{{"mode", "user"}, {"host", "a"}}}, `cpu{host="a",mode="user"}`},
+		{NewSeries("up", map[string]string{"job": `say "hi", {x}`}), `up{job="say \"hi\", {x}"}`},
+		{Series{Name: `cpu{host="a"}`}, `cpu\{host="a"}`},
+		{Series{Name: `a\`}, `a\\`},
+		{NewSeries(`c{p}u`, map[string]string{`h="o",st`: "a", `\`: "b"}), `c\{p}u{\\="b",h\=\"o\"\,st="a"}`},
+	}
+
+	for _, e := range tests {
+		output := e.series.String()
+		if output != e.expected {
+			t.Errorf("%v: expected [%v], got [%v]", fn, e.expected, output)
+		}
+
+		parsed, err := ParseSeries(output)
+		if err != nil {
+			t.Errorf("%v: cannot parse [%v], err [%v]", fn, output, err)
+		}
+		if parsed.String() != output {
+			t.Errorf("%v: expected [%v] after parsing, got [%v]", fn, output, parsed.String())
+		}
+	}
+
+	if (Series{Name: "key_1"}).String() != "key_1" {
+		t.Errorf("%v: expected series without labels to keep the row keys of plain keys", fn)
+	}
+}
+
+func TestSeriesStringCollisions(t *testing.T) {
+	const fn = "TestSeriesStringCollisions"
+
+	// pairs of series which would serialize the same if names were not escaped
+	tests := [][2]Series{
+		{Series{Name: `cpu{host="a"}`}, NewSeries("cpu", map[string]string{"host": "a"})},
+		{NewSeries("cpu", map[string]string{`host="a",mode`: "b"}), NewSeries("cpu", map[string]string{"host": "a", "mode": "b"})},
+		{NewSeries(`cpu{a="1"}`, map[string]string{"b": "2"}), NewSeries("cpu", map[string]string{"a": "1", `}{b`: "2"})},
+		{Series{Name: `a\{b}`}, Series{Name: `a{b}`}},
+	}
+
+	for _, e := range tests {
+		if e[0].String() == e[1].String() {
+			t.Errorf("%v: [%+v] and [%+v] both serialize to [%v]", fn, e[0], e[1], e[0].String())
+		}
+		for _, series := range e {
+			parsed, err := ParseSeries(series.String())
+			if err != nil || !reflect.DeepEqual(parsed, series) {
+				t.Errorf("%v: expected [%+v] parsing [%v], got [%+v], err [%v]", fn, series, series.String(), parsed, err)
+			}
+		}
+	}
+}
+
+func TestParseSeries(t *testing.T) {
+	const fn = "TestParseSeries"
+
+	output, err := ParseSeries(`cpu{mode="user",host="a"}`)
+	expected := Series{Name: "cpu", Labels: []Label{{"host", "a"}, {"mode", "user"}}}
+	if err != nil || !reflect.DeepEqual(output, expected) {
+		t.Errorf("%v: expected [%+v], got [%+v], err [%v]", fn, expected, output, err)
+	}
+
+	invalid := []string{`cpu{`, `cpu{}`, `cpu{host}`, `cpu{host=a}`, `cpu{host="a"`, `cpu{host="a" mode="b"}`,
+		`cpu{host="a",host="b"}`, `cpu{="a"}`, `cpu\`, `cpu{host\`}
+	for _, e := range invalid {
+		if _, err := ParseSeries(e); err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package btutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	spoolExt = ".spool"
+	// spoolHeaderSize is the size of the header of a record: the length and
+	// the checksum of its payload
+	spoolHeaderSize = 8
+)
+
+var spoolTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrSpoolFull is returned by Spool.Append when a record would take the spool
+// over its size limit.
+var ErrSpoolFull = errors.New("spool full")
+
+// spoolSegment is a segment file of a spool.
+type spoolSegment struct {
+	seq  uint64
+	size int64
+	// replayed is the offset of the first record not replayed yet
+	replayed int64
+}
+
+// Spool is an append only log on disk of points that could not be written,
+// to write them again later. Records are appended to segment files, each
+// record being the length and the crc32 of its payload followed by the
+// payload. A segment is sealed by a replay or once it reaches the segment
+// size, and removed once all its records were replayed.
+//
+// Records are synced to disk before Append returns, so that points spooled
+// survive a crash. Points replayed before a crash are replayed again after
+// it. With the sec and hourcol layouts, writing a point again overwrites the
+// same cell, so that it is harmless. With hourblob and hourgorilla, a replay
+// writes a new blob, and as the newest blob wins for points at the same
+// second, a replayed point shadows a point written for that second since it
+// was spooled.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	lock sync.Mutex
+	// segments are oldest first. The last one is appended to if w is not nil.
+	segments []*spoolSegment
+	w        *os.File
+	nextSeq  uint64
+	bytes    int64
+
+	replayLock sync.Mutex
+
+	// number of corrupt records, dropped with the rest of their segment
+	numCorrupt uint64
+}
+
+// OpenSpool opens the spool in dir, creating dir if it does not exist.
+// Segments left by a previous process are kept to be replayed. maxBytes caps
+// the size of all segments and segmentBytes the size of one.
+func OpenSpool(dir string, maxBytes, segmentBytes int64) (*Spool, error) {
+	if maxBytes <= 0 || segmentBytes <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid spool sizes, max [%v], segment [%v]. should be positive",
+			maxBytes, segmentBytes))
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes, nextSeq: 1}
+	for _, e := range infos {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolExt), 10, 64)
+		if err != nil {
+			log.Printf("skipping unknown file [%v] in spool [%v]", e.Name(), dir)
+			continue
+		}
+
+		s.segments = append(s.segments, &spoolSegment{seq: seq, size: e.Size()})
+		s.bytes += e.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	log.Printf("opened spool [%v] with [%v] segments of [%v] bytes", dir, len(s.segments), s.bytes)
+	return s, nil
+}
+
+// Append appends a record of points to the spool and syncs it to disk. It
+// returns ErrSpoolFull if the record would take the spool over its size limit.
+func (s *Spool) Append(points []KeyValueEpochsec) error {
+	record := encodeSpoolRecord(points)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.bytes+int64(len(record)) > s.maxBytes {
+		return ErrSpoolFull
+	}
+
+	if s.w != nil && s.segments[len(s.segments)-1].size >= s.segmentBytes {
+		err := s.seal()
+		if err != nil {
+			return err
+		}
+	}
+	if s.w == nil {
+		seg := &spoolSegment{seq: s.nextSeq}
+		w, err := os.OpenFile(s.path(seg), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		s.nextSeq++
+		s.segments = append(s.segments, seg)
+		s.w = w
+
+		// the new segment is lost in a crash unless its directory entry is synced
+		err = syncDir(s.dir)
+		if err != nil {
+			s.seal()
+			return err
+		}
+	}
+
+	n, err := s.w.Write(record)
+	seg := s.segments[len(s.segments)-1]
+	seg.size += int64(n)
+	s.bytes += int64(n)
+	if err == nil {
+		err = s.w.Sync()
+	}
+	if err != nil {
+		// the segment may end with a partial record now
+		s.seal()
+		return err
+	}
+
+	return nil
+}
+
+// Replay passes the records of the spool to fn, oldest first, and removes
+// the records fn returns nil for. It stops at the first error of fn and
+// returns it, so that the record is passed again by the next replay.
+// Corrupt records are dropped with the rest of their segment.
+func (s *Spool) Replay(fn func(points []KeyValueEpochsec) error) error {
+	s.replayLock.Lock()
+	defer s.replayLock.Unlock()
+
+	s.lock.Lock()
+	err := s.seal()
+	segments := append([]*spoolSegment(nil), s.segments...)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		err = s.replaySegment(seg, fn)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(s.path(seg))
+		if err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		s.segments = s.segments[1:]
+		s.bytes -= seg.size
+		s.lock.Unlock()
+	}
+
+	return nil
+}
+
+// Bytes returns the size of the segments of the spool.
+func (s *Spool) Bytes() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.bytes
+}
+
+// NumCorrupt returns the number of records dropped as corrupt.
+func (s *Spool) NumCorrupt() uint64 {
+	return atomic.LoadUint64(&s.numCorrupt)
+}
+
+// Close closes the segment being appended to. Its records are replayed once
+// the spool is opened again.
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.seal()
+}
+
+// seal syncs and stops appending to the last segment. The lock must be held.
+func (s *Spool) seal() error {
+	if s.w == nil {
+		return nil
+	}
+
+	err := s.w.Sync()
+	if closeErr := s.w.Close(); err == nil {
+		err = closeErr
+	}
+	s.w = nil
+	return err
+}
+
+// syncDir syncs the entries of dir to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+func (s *Spool) path(seg *spoolSegment) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%v", seg.seq, spoolExt))
+}
+
+// replaySegment passes the records of a sealed segment not replayed yet to fn.
+func (s *Spool) replaySegment(seg *spoolSegment, fn func(points []KeyValueEpochsec) error) error {
+	b, err := ioutil.ReadFile(s.path(seg))
+	if err != nil {
+		return err
+	}
+
+	for seg.replayed < int64(len(b)) {
+		points, n, err := decodeSpoolRecord(b[seg.replayed:])
+		if err != nil {
+			atomic.AddUint64(&s.numCorrupt, 1)
+			log.Printf("dropping the rest of spool segment [%v] from offset [%v]. err [%v]",
+				s.path(seg), seg.replayed, err)
+			return nil
+		}
+
+		err = fn(points)
+		if err != nil {
+			return err
+		}
+		seg.replayed += int64(n)
+	}
+
+	return nil
+}
+
+// encodeSpoolRecord encodes points into a record. The payload is every point
+// as the length of its series, the series, the value and the time.
+func encodeSpoolRecord(points []KeyValueEpochsec) []byte {
+	record := make([]byte, spoolHeaderSize)
+	var buf [binary.MaxVarintLen64]byte
+	for _, e := range points {
+		series := e.Series.String()
+		n := binary.PutUvarint(buf[:], uint64(len(series)))
+		record = append(record, buf[:n]...)
+		record = append(record, series...)
+
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(e.Value))
+		record = append(record, buf[:8]...)
+		binary.BigEndian.PutUint32(buf[:], e.Epochsec)
+		record = append(record, buf[:4]...)
+	}
+
+	payload := record[spoolHeaderSize:]
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, spoolTable))
+	return record
+}
+
+// decodeSpoolRecord decodes the record at the start of b. It returns its
+// points and its size.
+func decodeSpoolRecord(b []byte) ([]KeyValueEpochsec, int, error) {
+	if len(b) < spoolHeaderSize {
+		return nil, 0, errors.New(fmt.Sprintf("truncated record header of [%v] bytes", len(b)))
+	}
+	length := int(binary.BigEndian.Uint32(b))
+	if len(b) < spoolHeaderSize+length {
+		return nil, 0, errors.New(fmt.Sprintf("truncated record of [%v] bytes. should be %v", len(b), spoolHeaderSize+length))
+	}
+	payload := b[spoolHeaderSize : spoolHeaderSize+length]
+	if crc32.Checksum(payload, spoolTable) != binary.BigEndian.Uint32(b[4:]) {
+		return nil, 0, errors.New("record checksum mismatch")
+	}
+
+	var points []KeyValueEpochsec
+	for len(payload) > 0 {
+		l, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < l+12 {
+			return nil, 0, errors.New("invalid point in record")
+		}
+		series, err := ParseSeries(string(payload[n : n+int(l)]))
+		if err != nil {
+			return nil, 0, err
+		}
+		payload = payload[n+int(l):]
+
+		points = append(points, KeyValueEpochsec{
+			Series:   series,
+			Value:    math.Float64frombits(binary.BigEndian.Uint64(payload)),
+			Epochsec: binary.BigEndian.Uint32(payload[8:]),
+		})
+		payload = payload[12:]
+	}
+
+	return points, spoolHeaderSize + length, nil
+}
@@ -0,0 +1,190 @@
+package btutil
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func spoolPoints(name string, n int) []KeyValueEpochsec {
+	var result []KeyValueEpochsec
+	for i := 0; i < n; i++ {
+		series := Series{Name: name, Labels: []Label{{"host", "a"}}}
+		result = append(result, KeyValueEpochsec{series, float64(i) + 0.5, uint32(1000 + i)})
+	}
+	return result
+}
+
+// replayAll replays spool and returns the records replayed.
+func replayAll(t *testing.T, fn string, spool *Spool) [][]KeyValueEpochsec {
+	var result [][]KeyValueEpochsec
+	err := spool.Replay(func(points []KeyValueEpochsec) error {
+		result = append(result, points)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v: cannot replay spool, err [%v]", fn, err)
+	}
+	return result
+}
+
+func TestSpool(t *testing.T) {
+	const fn = "TestSpool"
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("%v: cannot create dir, err [%v]", fn, err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small segments, so that every record rolls a segment
+	spool, err := OpenSpool(dir, 1<<20, 10)
+	if err != nil {
+		t.Fatalf("%v: cannot open spool, err [%v]", fn, err)
+	}
+
+	records := [][]KeyValueEpochsec{spoolPoints("a", 2), spoolPoints("b", 1), spoolPoints("c", 3)}
+	for _, e := range records {
+		err = spool.Append(e)
+		if err != nil {
+			t.Fatalf("%v: cannot append, err [%v]", fn, err)
+		}
+	}
+
+	// a failed replay keeps the failed record and the ones after it
+	var replayed [][]KeyValueEpochsec
+	err = spool.Replay(func(points []KeyValueEpochsec) error {
+		if len(replayed) == 1 {
+			return errors.New("write failed")
+		}
+		replayed = append(replayed, points)
+		return nil
+	})
+	if err == nil || !reflect.DeepEqual(replayed, records[:1]) {
+		t.Errorf("%v: failed replay returned [%v], replayed [%v]. expected an error and [%v]", fn, err, replayed, records[:1])
+	}
+
+	// the spool is read back after reopening it
+	err = spool.Close()
+	if err != nil {
+		t.Fatalf("%v: cannot close spool, err [%v]", fn, err)
+	}
+	spool, err = OpenSpool(dir, 1<<20, 10)
+	if err != nil {
+		t.Fatalf("%v: cannot reopen spool, err [%v]", fn, err)
+	}
+	replayed = replayAll(t, fn, spool)
+	if !reflect.DeepEqual(replayed, records[1:]) {
+		t.Errorf("%v: replayed [%v], expected [%v]", fn, replayed, records[1:])
+	}
+	if spool.Bytes() != 0 {
+		t.Errorf("%v: spool has [%v] bytes after replay, expected 0", fn, spool.Bytes())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if len(files) != 0 {
+		t.Errorf("%v: segments [%v] left after replay", fn, files)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	const fn = "TestSpoolFull"
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("%v: cannot create dir, err [%v]", fn, err)
+	}
+	defer os.RemoveAll(dir)
+
+	record := encodeSpoolRecord(spoolPoints("a", 1))
+	spool, err := OpenSpool(dir, int64(2*len(record)), 1<<20)
+	if err != nil {
+		t.Fatalf("%v: cannot open spool, err [%v]", fn, err)
+	}
+
+	for i, expected := range []error{nil, nil, ErrSpoolFull} {
+		err = spool.Append(spoolPoints("a", 1))
+		if err != expected {
+			t.Errorf("%v: append [%v] returned [%v], expected [%v]", fn, i, err, expected)
+		}
+	}
+
+	replayAll(t, fn, spool)
+	err = spool.Append(spoolPoints("a", 1))
+	if err != nil {
+		t.Errorf("%v: append after replay returned [%v], expected nil", fn, err)
+	}
+}
+
+func TestSpoolCorrupt(t *testing.T) {
+	const fn = "TestSpoolCorrupt"
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("%v: cannot create dir, err [%v]", fn, err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("%v: cannot open spool, err [%v]", fn, err)
+	}
+	for _, e := range []string{"a", "b", "c"} {
+		err = spool.Append(spoolPoints(e, 1))
+		if err != nil {
+			t.Fatalf("%v: cannot append, err [%v]", fn, err)
+		}
+	}
+	spool.Close()
+
+	// flip a byte of the payload of the second record
+	path := filepath.Join(dir, "00000000000000000001"+spoolExt)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v: cannot read segment, err [%v]", fn, err)
+	}
+	b[len(encodeSpoolRecord(spoolPoints("a", 1)))+spoolHeaderSize] ^= 0xff
+	err = ioutil.WriteFile(path, b, 0644)
+	if err != nil {
+		t.Fatalf("%v: cannot write segment, err [%v]", fn, err)
+	}
+
+	replayed := replayAll(t, fn, spool)
+	expected := [][]KeyValueEpochsec{spoolPoints("a", 1)}
+	if !reflect.DeepEqual(replayed, expected) || spool.NumCorrupt() != 1 {
+		t.Errorf("%v: replayed [%v] with [%v] corrupt records, expected [%v] with 1", fn, replayed, spool.NumCorrupt(), expected)
+	}
+}
+
+func TestDecodeSpoolRecord(t *testing.T) {
+	const fn = "TestDecodeSpoolRecord"
+
+	record := encodeSpoolRecord(spoolPoints("a", 2))
+	tests := []struct {
+		name  string
+		input []byte
+		valid bool
+	}{
+		{"whole", record, true},
+		{"trailing bytes", append(append([]byte(nil), record...), 1, 2, 3), true},
+		{"truncated header", record[:4], false},
+		{"truncated payload", record[:len(record)-1], false},
+	}
+
+	for _, test := range tests {
+		points, n, err := decodeSpoolRecord(test.input)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%v: %v: expected an error", fn, test.name)
+			}
+			continue
+		}
+		if err != nil || n != len(record) || !reflect.DeepEqual(points, spoolPoints("a", 2)) {
+			t.Errorf("%v: %v: decoded [%v] of [%v] bytes, err [%v]. expected [%v] of [%v] bytes",
+				fn, test.name, points, n, err, spoolPoints("a", 2), len(record))
+		}
+	}
+}
@@ -2,18 +2,47 @@ package btutil
 
 import (
 	"fmt"
-	"crypto/md5"
+	"sort"
 	"strconv"
 	"bytes"
 	"encoding/binary"
 	"log"
 	"strings"
 	"errors"
+	"math"
 )
 
 type RowKey string
 
+// epochsecDigits is the number of digits of the zero padded epochsec in row
+// keys. It fits any uint32 so that keys sort in time order.
+const epochsecDigits = 10
+
+// hourDigits is the number of digits of the zero padded hour in GetBTKey row keys.
+const hourDigits = 7
+
+// Epochsec returns the epochsec of a row key generated by BTRowKeyStr.
 func (r RowKey) Epochsec() (uint32, error) {
+	return r.timeToken(epochsecDigits)
+}
+
+// Hour returns the hour of a row key generated by GetBTKey.
+func (r RowKey) Hour() (uint32, error) {
+	return r.timeToken(hourDigits)
+}
+
+// BinaryBucket returns the time bucket of a binary row key, see KeyFormat.
+func (r RowKey) BinaryBucket() (uint32, error) {
+	if len(r) <= binaryBucketSize {
+		err := errors.New(fmt.Sprintf("invalid binary row key [%x]. should have more than %v bytes", string(r), binaryBucketSize))
+		log.Printf("err [%v]", err)
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32([]byte(r[len(r)-binaryBucketSize:])), nil
+}
+
+func (r RowKey) timeToken(digits int) (uint32, error) {
 	split := strings.Split(string(r), "_")
 
 	if len(split) != 2 {
@@ -22,18 +51,24 @@ func (r RowKey) Epochsec() (uint32, error) {
 		return 0, err
 	}
 
-	epochsec, err := strconv.Atoi(split[1])
+	if len(split[1]) != digits {
+		err := errors.New(fmt.Sprintf("invalid row key [%v]. time should have %v digits", r, digits))
+		log.Printf("err [%v]", err)
+		return 0, err
+	}
+
+	token, err := strconv.ParseUint(split[1], 10, 32)
 	if err != nil {
 		log.Printf("%v", err)
 		return 0, err
 	}
 
-	return uint32(epochsec), nil
+	return uint32(token), nil
 }
 
 
 type KeyValueEpochsec struct {
-	Key      string
+	Series   Series
 	Value    float64
 	Epochsec uint32
 }
@@ -45,9 +80,7 @@ func (k *KeyValueEpochsec) BTRowKey() RowKey {
 
 func (k *KeyValueEpochsec) BTRowKeyStr() string {
 
-	md5Sum := fmt.Sprintf("%x", md5.Sum([]byte(k.Key)))
-	s := md5Sum + "_" + strconv.Itoa(int(k.Epochsec))
-	return s
+	return KeyFormat{}.rowKey(k.Series.String(), k.Epochsec, epochsecDigits)
 }
 
 func (k *KeyValueEpochsec) ValueByteArray() []byte {
@@ -59,3 +92,94 @@ func (k *KeyValueEpochsec) ValueByteArray() []byte {
 
 	return buffer.Bytes()
 }
+
+type TimeValue struct {
+	Epochsec uint32
+	Value    float64
+}
+
+type KeyTimevalues struct {
+	Series     Series
+	Timevalues []TimeValue
+}
+
+// GroupBySeries groups points by series, keeping the order in which series and points appear.
+func GroupBySeries(slice []KeyValueEpochsec) []KeyTimevalues {
+	index := make(map[string]int)
+
+	var result []KeyTimevalues
+	for _, e := range slice {
+		key := e.Series.String()
+		i, found := index[key]
+		if !found {
+			i = len(result)
+			index[key] = i
+			result = append(result, KeyTimevalues{Series: e.Series})
+		}
+		result[i].Timevalues = append(result[i].Timevalues, TimeValue{e.Epochsec, e.Value})
+	}
+
+	return result
+}
+
+// SplitByBucket splits the points of a series into one KeyTimevalues per bucket
+// of width seconds, in the order the buckets first appear.
+func SplitByBucket(ktv KeyTimevalues, width uint32) []KeyTimevalues {
+	index := make(map[uint32]int)
+
+	var result []KeyTimevalues
+	for _, e := range ktv.Timevalues {
+		bucket := e.Epochsec / width
+		i, found := index[bucket]
+		if !found {
+			i = len(result)
+			index[bucket] = i
+			result = append(result, KeyTimevalues{Series: ktv.Series})
+		}
+		result[i].Timevalues = append(result[i].Timevalues, e)
+	}
+
+	return result
+}
+
+// MergePoints sorts points by time. When several points share a second, the
+// one appearing last wins.
+func MergePoints(points []TimeValue) []TimeValue {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Epochsec < points[j].Epochsec
+	})
+
+	var result []TimeValue
+	for _, e := range points {
+		if len(result) > 0 && result[len(result)-1].Epochsec == e.Epochsec {
+			result[len(result)-1] = e
+			continue
+		}
+		result = append(result, e)
+	}
+
+	return result
+}
+
+// FilterWindow returns the points in [from, until).
+func FilterWindow(points []TimeValue, from, until uint32) []TimeValue {
+	var result []TimeValue
+	for _, e := range points {
+		if e.Epochsec >= from && e.Epochsec < until {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// Epochsec clamps unix seconds to the range of the times of points.
+func Epochsec(unix int64) uint32 {
+	if unix < 0 {
+		return 0
+	}
+	if unix > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(unix)
+}
@@ -0,0 +1,44 @@
+package btutil
+
+import "testing"
+
+func TestBTRowKeyStrOrder(t *testing.T) {
+	const fn = "TestBTRowKeyStrOrder"
+
+	epochsecs := []uint32{0, 9, 10, 999999999, 1000000000, 1500000000, 4294967295}
+	for i := 1; i < len(epochsecs); i++ {
+		prev := KeyValueEpochsec{Series: Series{Name: "key_1"}, Epochsec: epochsecs[i-1]}
+		cur := KeyValueEpochsec{Series: Series{Name: "key_1"}, Epochsec: epochsecs[i]}
+		if prev.BTRowKeyStr() >= cur.BTRowKeyStr() {
+			t.Errorf("%v: expected [%v] < [%v]", fn, prev.BTRowKeyStr(), cur.BTRowKeyStr())
+		}
+	}
+
+	for _, e := range epochsecs {
+		kves := KeyValueEpochsec{Series: Series{Name: "key_1"}, Epochsec: e}
+		output, err := kves.BTRowKey().Epochsec()
+		if err != nil || output != e {
+			t.Errorf("%v: expected [%v] from [%v], got [%v], err [%v]", fn, e, kves.BTRowKeyStr(), output, err)
+		}
+	}
+}
+
+func TestRowKeyEpochsecInvalid(t *testing.T) {
+	const fn = "TestRowKeyEpochsecInvalid"
+
+	tests := []RowKey{
+		"a",
+		"a_b_c",
+		"d41d8cd98f00b204e9800998ecf8427e_1500000",
+		"d41d8cd98f00b204e9800998ecf8427e_15000000000",
+		"d41d8cd98f00b204e9800998ecf8427e_150000000x",
+		"d41d8cd98f00b204e9800998ecf8427e_9999999999",
+	}
+
+	for _, e := range tests {
+		_, err := e.Epochsec()
+		if err == nil {
+			t.Errorf("%v: expected error for [%v]", fn, e)
+		}
+	}
+}
@@ -8,12 +8,8 @@ import (
 	"os"
 	"time"
 
-	"bytes"
-	"crypto/md5"
-	"encoding/binary"
 	"math/rand"
 
-	"cloud.google.com/go/bigtable"
 	"golang.org/x/net/context"
 )
 
@@ -23,9 +19,11 @@ func main() {
 		instance         = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
 		authfile         = flag.String("authjson", "", "Google application credentials json file.")
 		table            = flag.String("table", "", "Table to write metrics.")
+		indexTable       = flag.String("index_table", "", "Table to index the written series in. Empty disables the index.")
 		datapointsPerRow = flag.Int("datapoints_per_row", 50, "datapoints per row")
-		numWriters       = flag.Int("num_writers", 100, "num saving goroutines")
-		writeBatchSize   = flag.Int("num_rows_per_write", 10, "rows per write")
+		writeBatchSize   = flag.Int("num_rows_per_write", 10, "rows generated together")
+		batcherFlags     = btutil.NewBatcherFlags(100, 500)
+		schemaFlags      = btutil.NewSchemaFlags("hourblob")
 	)
 	//ex: bin/btwritestress -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec -dps 10000
 
@@ -37,19 +35,19 @@ func main() {
 
 	client, _ := btutil.Clients(*project, *instance, *authfile)
 	tbl := client.Open(*table)
+	schema := schemaFlags.Schema()
 
-	ch := make(chan []KeyTimevalues) //unbuffered
+	var index *btutil.SeriesIndex
+	if *indexTable != "" {
+		index = btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+	}
 
-	go genMetrics(*writeBatchSize, *datapointsPerRow, ch)
+	log.Printf("write batch size [%v], data points per row [%v]", *writeBatchSize, *datapointsPerRow)
+	batcher := btutil.NewBatcher(context.Background(), tbl, schema, index, batcherFlags.Config())
 
 	counter := btutil.NewCounter()
 
-	ctx := context.Background()
-	log.Printf("num savers: [%v], write batch size [%v], data points per row [%v]",
-		*numWriters, *writeBatchSize, *datapointsPerRow)
-	for i := 0; i < *numWriters; i++ {
-		go writer(ctx, ch, tbl, counter)
-	}
+	go genMetrics(*writeBatchSize, *datapointsPerRow, batcher, counter)
 
 	go periodicallyPrintMetrics(counter)
 
@@ -64,105 +62,26 @@ func periodicallyPrintMetrics(counter *btutil.Counter) {
 	}
 }
 
-func writer(ctx context.Context, ch <-chan []KeyTimevalues, tbl *bigtable.Table, counter *btutil.Counter) {
-	for slice := range ch {
-		if len(slice) != 0 {
-			write(ctx, slice, tbl, counter)
-		}
-	}
-}
-
-type SecofhourValue struct {
-	SecOfHour uint16
-	Value     float64
-}
-
-func toBigEndianBytes(slice []SecofhourValue) []byte {
-	var buffer bytes.Buffer
-	err := binary.Write(&buffer, binary.BigEndian, slice)
-	if err != nil {
-		log.Fatalf("cannot convert slice %+v to byte array, err [%v]")
-	}
-
-	return buffer.Bytes()
-}
-
-func md5Str(input []byte) string {
-	md5bytes := md5.Sum(input)
-
-	return string(md5bytes[:])
-}
-
-func write(ctx context.Context, slice []KeyTimevalues, tbl *bigtable.Table, counter *btutil.Counter) {
-
-	const column_family = "0"
-
-	var rowKeys []string
-	var muts []*bigtable.Mutation
-	var numDatapoints int
-	for _, e := range slice {
-		var secofhourValues []SecofhourValue
-		for _, e2 := range e.Timevalues {
-			//todo: case when falls to next hour
-			secofhourValues = append(secofhourValues, SecofhourValue{uint16(e2.Epochsec % 3600), e2.Value})
-			numDatapoints++
-		}
-
-		mut := bigtable.NewMutation()
-
-		bytes := toBigEndianBytes(secofhourValues)
-		mut.Set(column_family, md5Str(bytes), 0, bytes)
-
-		muts = append(muts, mut)
-		rowKeys = append(rowKeys, btutil.GetBTKey(e.Key, e.Timevalues[0].Epochsec))
-	}
-
-	errors, err := tbl.ApplyBulk(ctx, rowKeys, muts)
-	if err != nil {
-		log.Printf("entire bulk mutation failed. err [%v]", err)
-		return
-	}
-	if errors != nil {
-		var i int
-		for _, e := range errors {
-			if err != nil {
-				log.Printf("applybulk failed for rowkey [%v], err [%v]", rowKeys[i], e)
-			}
-			i++
-		}
-		return
-	}
-
-	counter.Mark(numDatapoints)
-}
-
-type TimeValue struct {
-	Epochsec uint32
-	Value    float64
-}
-
-type KeyTimevalues struct {
-	Key        string
-	Timevalues []TimeValue
-}
-
-func genMetrics(numKeys int, datapointsPerKey int, ch chan<- []KeyTimevalues) {
+func genMetrics(numKeys int, datapointsPerKey int, batcher *btutil.Batcher, counter *btutil.Counter) {
 
 	for {
 		nowEpochsec := int(time.Now().Unix())
 
-		var slice []KeyTimevalues
+		var slice []btutil.KeyValueEpochsec
 		for i := 0; i < numKeys; i++ {
-			ktv := KeyTimevalues{Key: getKey(rand.Intn(1000 * 1000))}
+			series := btutil.Series{Name: getKey(rand.Intn(1000 * 1000))}
 
 			for j := 0; j < datapointsPerKey; j++ {
 				epochsec := nowEpochsec - datapointsPerKey + j + 1
-				ktv.Timevalues = append(ktv.Timevalues, TimeValue{uint32(epochsec), float64(epochsec)})
+				slice = append(slice, btutil.KeyValueEpochsec{Series: series, Value: float64(epochsec), Epochsec: uint32(epochsec)})
 			}
-			slice = append(slice, ktv)
 		}
 
-		ch <- slice
+		batcher.Add(slice, func(err error) {
+			if err == nil {
+				counter.Mark(len(slice))
+			}
+		})
 	}
 }
 
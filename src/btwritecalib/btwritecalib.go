@@ -8,20 +8,18 @@ import (
 	"os"
 	"time"
 
-	"strconv"
-
-	"cloud.google.com/go/bigtable"
 	"golang.org/x/net/context"
 )
 
 func main() {
 	var (
-		project        = flag.String("project", "", "The name of the project.")
-		instance       = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
-		authfile       = flag.String("authjson", "", "Google application credentials json file.")
-		table          = flag.String("table", "", "Table to write metrics.")
-		numWriters     = flag.Int("num_writers", 100, "num saving goroutines")
-		writeBatchSize = flag.Int("write_batch_size", 1000, "write batch size")
+		project      = flag.String("project", "", "The name of the project.")
+		instance     = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile     = flag.String("authjson", "", "Google application credentials json file.")
+		table        = flag.String("table", "", "Table to write metrics.")
+		indexTable   = flag.String("index_table", "", "Table to index the written series in. Empty disables the index.")
+		batcherFlags = btutil.NewBatcherFlags(100, 1000)
+		schemaFlags  = btutil.NewSchemaFlags("hourcol")
 	)
 	//ex: bin/btwritestress -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec -dps 10000
 
@@ -33,18 +31,19 @@ func main() {
 
 	client, _ := btutil.Clients(*project, *instance, *authfile)
 	tbl := client.Open(*table)
+	schema := schemaFlags.Schema()
 
-	ch := make(chan []btutil.KeyValueEpochsec) //unbuffered
+	var index *btutil.SeriesIndex
+	if *indexTable != "" {
+		index = btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+	}
 
-	go genMetrics(*writeBatchSize, ch)
+	config := batcherFlags.Config()
+	batcher := btutil.NewBatcher(context.Background(), tbl, schema, index, config)
 
 	counter := btutil.NewCounter()
 
-	ctx := context.Background()
-	log.Printf("num savers: [%v], write batch size [%v]", *numWriters, *writeBatchSize)
-	for i := 0; i < *numWriters; i++ {
-		go writer(ctx, ch, tbl, counter)
-	}
+	go genMetrics(config.MaxPoints, batcher, counter)
 
 	go periodicallyPrintMetrics(counter)
 
@@ -59,58 +58,26 @@ func periodicallyPrintMetrics(counter *btutil.Counter) {
 	}
 }
 
-func writer(ctx context.Context, ch <-chan []btutil.KeyValueEpochsec, tbl *bigtable.Table, counter *btutil.Counter) {
-	for slice := range ch {
-		if len(slice) != 0 {
-			write(ctx, slice, tbl, counter)
-		}
-	}
-}
-
-func write(ctx context.Context, slice []btutil.KeyValueEpochsec, tbl *bigtable.Table, counter *btutil.Counter) {
-
-	var rowKeys []string
-	var muts []*bigtable.Mutation
-	for _, e := range slice {
-		mut := bigtable.NewMutation()
-		secOfHour := int(e.Epochsec % 3600)
-		mut.Set("0", strconv.Itoa(secOfHour), 0, e.ValueByteArray())
-
-		muts = append(muts, mut)
-		rowKeys = append(rowKeys, btutil.GetBTKey(e.Key, e.Epochsec))
-	}
-
-	errors, err := tbl.ApplyBulk(ctx, rowKeys, muts)
-	if err != nil {
-		log.Printf("entire bulk mutation failed. err [%v]", err)
-		return
-	}
-	if errors != nil {
-		var i int
-		for _, e := range errors {
-			if err != nil {
-				log.Printf("applybulk failed for rowkey [%v], err [%v]", rowKeys[i], e)
-			}
-			i++
-		}
-		return
-	}
-
-	counter.Mark(len(slice))
-}
-
-func genMetrics(n int, ch chan<- []btutil.KeyValueEpochsec) {
+func genMetrics(n int, batcher *btutil.Batcher, counter *btutil.Counter) {
 
 	for {
 		start := time.Now()
 
 		var slice []btutil.KeyValueEpochsec
 		for i := 0; i < n; i++ {
-			kves := btutil.KeyValueEpochsec{getKey(i), float64(start.Unix()), uint32(start.Unix())}
+			kves := btutil.KeyValueEpochsec{
+				Series:   btutil.Series{Name: getKey(i)},
+				Value:    float64(start.Unix()),
+				Epochsec: uint32(start.Unix()),
+			}
 			slice = append(slice, kves)
 		}
 
-		ch <- slice
+		batcher.Add(slice, func(err error) {
+			if err == nil {
+				counter.Mark(len(slice))
+			}
+		})
 	}
 }
 
@@ -8,25 +8,20 @@ import (
 	"os"
 	"time"
 
-	"sync/atomic"
-
-	"cloud.google.com/go/bigtable"
 	"golang.org/x/net/context"
 )
 
-var (
-	totalTimeMicros, numWrites uint64
-)
-
 func main() {
 	var (
 		project   = flag.String("project", "", "The name of the project.")
 		instance  = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
 		authfile  = flag.String("authjson", "", "Google application credentials json file.")
 		table     = flag.String("table", "", "Table to write metrics.")
+		indexTable = flag.String("index_table", "", "Table to index the written series in. Empty disables the index.")
 		dps       = flag.Int("dps", 100000, "Data points per second.")
-		numWriters = flag.Int("num_writers", 10, "num saving goroutines")
-		writeBatchSize = flag.Int("write_batch_size", 1000, "write batch size")
+		batcherFlags = btutil.NewBatcherFlags(10, 1000)
+		schemaFlags = btutil.NewSchemaFlags("sec")
+		genFlags = btutil.NewBackpressureFlags("gen")
 	)
 	//ex: bin/btwritestress -authjson ~/zdatalab-credentials.json -instance sathyatest -project zdatalab-1316 -table sec -dps 10000
 
@@ -40,118 +35,61 @@ func main() {
 
 	client, _ := btutil.Clients(*project, *instance, *authfile)
 	tbl := client.Open(*table)
+	schema := schemaFlags.Schema()
+
+	var index *btutil.SeriesIndex
+	if *indexTable != "" {
+		index = btutil.NewSeriesIndex(client.Open(*indexTable), schema.Format())
+	}
 
-	ch1 := make(chan btutil.KeyValueEpochsec, *dps*100)
+	ctx := context.Background()
+	batcher := btutil.NewBatcher(ctx, tbl, schema, index, batcherFlags.Config())
 
-	go genMetrics(*dps, ch1)
+	ch := make(chan btutil.KeyValueEpochsec, *dps*100)
+	stage := btutil.NewStage[btutil.KeyValueEpochsec]("gen", genFlags.Config())
 
-	ch2 := make(chan []btutil.KeyValueEpochsec) //unbuffered channel
-	go periodicallyDrainAndWriteToCh(ch1, *writeBatchSize, ch2)
+	go genMetrics(*dps, ch, stage)
 
-	ctx := context.Background()
-	log.Printf("num savers: [%v], write batch size [%v]", *numWriters, *writeBatchSize)
-	for i := 0; i < *numWriters; i++ {
-		go writer(ctx, ch2, tbl)
-	}
+	go addToBatcher(ch, batcher)
 
-	go periodicallyPrintMetrics(ch1, *dps)
+	go periodicallyPrintMetrics(ch, batcher, *dps, stage)
 
 	select {}
 }
 
-func periodicallyPrintMetrics(ch <-chan btutil.KeyValueEpochsec, incomingDps int) {
+func periodicallyPrintMetrics(ch <-chan btutil.KeyValueEpochsec, batcher *btutil.Batcher, incomingDps int, stage *btutil.Stage[btutil.KeyValueEpochsec]) {
 	start := time.Now()
 	for {
 		time.Sleep(time.Second * 5)
 		elapsed := time.Since(start)
-		n := atomic.LoadUint64(&numWrites)
+		n := batcher.NumWrites()
 		outgoingDps := n / uint64(elapsed.Seconds())
 		pctfull := len(ch) * 100 / cap(ch)
 		log.Printf("dps in/out: %v/%v, ch len/pctfull: %v/%v, num writes: %v, elapsed: %v",
 			incomingDps, outgoingDps, len(ch), pctfull, n, elapsed)
+		log.Printf("%v, batcher dropped/spooled/dead letters: %v/%v/%v",
+			stage, batcher.NumDropped(), batcher.NumSpooled(), batcher.NumDeadLetters())
 	}
 }
 
-func periodicallyDrainAndWriteToCh(input <-chan btutil.KeyValueEpochsec, maxSize int,
-	output chan<- []btutil.KeyValueEpochsec) {
-
-	for {
-		slice := drain(input, maxSize)
-		output <- slice
-	}
-}
-
-func drain(input <-chan btutil.KeyValueEpochsec, maxSize int) []btutil.KeyValueEpochsec {
-	timeoutCh := time.After(time.Second)
-
-	var slice []btutil.KeyValueEpochsec
-
-	for {
-		select {
-		case kves := <-input:
-			slice = append(slice, kves)
-			if len(slice) >= maxSize {
-				return slice
-			}
-		case <-timeoutCh:
-			return slice
-		}
-	}
-}
-
-func writer(ctx context.Context, ch <-chan []btutil.KeyValueEpochsec, tbl *bigtable.Table) {
-	for slice := range ch {
-		if len(slice) != 0 {
-			save(ctx, slice, tbl)
-		}
+func addToBatcher(ch <-chan btutil.KeyValueEpochsec, batcher *btutil.Batcher) {
+	for kves := range ch {
+		batcher.Add([]btutil.KeyValueEpochsec{kves}, nil)
 	}
 }
 
-func save(ctx context.Context, slice []btutil.KeyValueEpochsec, tbl *bigtable.Table) {
-
-	var rowKeys []string
-	var muts []*bigtable.Mutation
-	for _, e := range slice {
-		mut := bigtable.NewMutation()
-		mut.Set("0", "0", 0, e.ValueByteArray())
-
-		muts = append(muts, mut)
-		rowKeys = append(rowKeys, e.BTRowKeyStr())
-	}
-
-	start := time.Now()
-	errors, err := tbl.ApplyBulk(ctx, rowKeys, muts)
-	if err != nil {
-		log.Printf("entire bulk mutation failed. err [%v]", err)
-		return
-	}
-	if errors != nil {
-		var i int
-		for _, e := range errors {
-			if err != nil {
-				log.Printf("applybulk failed for rowkey [%v], err [%v]", rowKeys[i], e)
-			}
-			i++
-		}
-		return
-	}
-
-	atomic.AddUint64(&totalTimeMicros, uint64(time.Since(start).Nanoseconds()/1000))
-	atomic.AddUint64(&numWrites, uint64(len(slice)))
-}
-
-func genMetrics(n int, ch chan<- btutil.KeyValueEpochsec) {
+func genMetrics(n int, ch chan btutil.KeyValueEpochsec, stage *btutil.Stage[btutil.KeyValueEpochsec]) {
 
 	for {
 		start := time.Now()
 		for i := 0; i < n; i++ {
-			kves := btutil.KeyValueEpochsec{getKey(i), float64(start.Unix()), uint32(start.Unix())}
-
-			select {
-			case ch <- kves:
-			default:
-				log.Fatalf("cannot write to ch. pctFull [%v]", pctFull(ch))
+			kves := btutil.KeyValueEpochsec{
+				Series:   btutil.Series{Name: getKey(i)},
+				Value:    float64(start.Unix()),
+				Epochsec: uint32(start.Unix()),
 			}
+
+			stage.Send(ch, kves)
 		}
 
 		timeTaken := time.Since(start)
@@ -167,7 +105,3 @@ func genMetrics(n int, ch chan<- btutil.KeyValueEpochsec) {
 func getKey(i int) string {
 	return fmt.Sprintf("key_%v", i)
 }
-
-func pctFull(ch chan<- btutil.KeyValueEpochsec) float64 {
-	return float64(len(ch)) * 100 / float64(cap(ch))
-}
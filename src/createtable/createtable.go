@@ -9,10 +9,11 @@ import (
 func main() {
 
 	var (
-		project  = flag.String("project", "", "The name of the project.")
-		instance = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
-		authfile = flag.String("authjson", "", "Google application credentials json file.")
-		table    = flag.String("table", "", "The name of the table.")
+		project    = flag.String("project", "", "The name of the project.")
+		instance   = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
+		authfile   = flag.String("authjson", "", "Google application credentials json file.")
+		table      = flag.String("table", "", "The name of the table.")
+		indexTable = flag.String("index_table", "", "The name of the series index table. Empty creates no index.")
 	)
 
 	flag.Parse()
@@ -24,4 +25,8 @@ func main() {
 	_, adminClient := btutil.Clients(*project, *instance, *authfile)
 
 	btutil.CreateTableWithCF0IfMissing(adminClient, *table)
+
+	if *indexTable != "" {
+		btutil.CreateTableWithCF0IfMissing(adminClient, *indexTable)
+	}
 }